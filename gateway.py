@@ -3,14 +3,31 @@ ClawMCP Gateway - MCP 服务管理平台
 自动启动 MCP 服务 + 提供工具元数据（让大模型自己生成 SKILL）
 """
 import os
+import re
 import sys
 import json
+import hmac
+import hashlib
+import uuid
+import base64
+import html
+import random
+import fnmatch
+import ipaddress
+import urllib.parse
 import asyncio
+import argparse
+import contextlib
+import contextvars
 import subprocess
 import signal
+import shutil
+import threading
 import time
-from typing import Dict, List, Optional
-from dataclasses import dataclass
+from collections import deque
+from typing import Any, Deque, Dict, List, Optional
+from dataclasses import dataclass, field, replace
+import aiohttp
 from aiohttp import web
 import yaml
 
@@ -20,11 +37,359 @@ import yaml
 BASE_DIR = os.path.dirname(os.path.abspath(__file__))
 CONFIG_PATH = os.getenv("CLAWMCP_CONFIG", os.path.join(BASE_DIR, "configs/config.yaml"))
 PORT = int(os.getenv("CLAWMCP_PORT", "8080"))
-INTERNAL_HOST = "0.0.0.0"
+# 监听地址：环境变量优先，其次 server.host，默认仅本机
+HOST = os.getenv("CLAWMCP_HOST", "")
+DEFAULT_HOST = "127.0.0.1"
+
+# stdout 上非 JSON 输出最多告警的次数；stderr 保留的行数
+STDOUT_NOISE_WARN_LIMIT = 5
+STDERR_TAIL_LINES = 200
+
+# 工具结果按 outputSchema 校验的级别
+VALIDATE_OFF = "off"
+VALIDATE_WARN = "warn"
+VALIDATE_STRICT = "strict"
+VALIDATE_MODES = (VALIDATE_OFF, VALIDATE_WARN, VALIDATE_STRICT)
+
+# MCP 请求默认超时（秒）：initialize 单独计时，冷启动的 uvx/npx 可能需要先下载依赖
+INIT_TIMEOUT = 120
+INIT_RETRIES = 2
+REQUEST_TIMEOUT = 30
+PING_TIMEOUT = 5
+# 调用到达时进程尚未完成初始化握手的最长等待（秒），超时返回 503
+READY_TIMEOUT = 10
+
+# 服务详情中获取实时工具列表的最长等待（秒），超时则返回缓存并标记 toolsStale
+TOOLS_FETCH_TIMEOUT = 3
+
+# 含二进制内容块的调用结果保留时长（秒），供下载接口读取
+RESULT_TTL = 300
+
+# 启动参数覆盖的取值：不能以 "-" 开头（防止注入额外参数），不含控制字符
+OVERRIDE_VALUE_RE = re.compile(r"^[^-\x00-\x1f][^\x00-\x1f]{0,1023}$")
+
+DURATION_RE = re.compile(r"^(\d+(?:\.\d+)?)(ms|s|m|h)?$")
+DURATION_UNITS = {"ms": 0.001, "s": 1, "m": 60, "h": 3600}
+
+
+HOSTNAME_RE = re.compile(r"^(?=.{1,253}$)[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?"
+                         r"(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$")
+
+
+def validate_host(host: str) -> str:
+    """校验监听地址（IP 或主机名）"""
+    try:
+        ipaddress.ip_address(host)
+        return host
+    except ValueError:
+        pass
+    if not HOSTNAME_RE.match(host):
+        raise ValueError(f"invalid bind address: {host!r}")
+    return host
+
+
+SERVICE_NAME_RE = re.compile(r"^[a-z0-9][a-z0-9._-]{0,62}$")
+
+
+def normalize_service_name(name: Any) -> str:
+    """规范化服务名（去除首尾空白、转小写）并校验字符集，保证可用于 URL 与容器名"""
+    normalized = str(name or "").strip().lower()
+    if not SERVICE_NAME_RE.match(normalized):
+        raise ValueError(f"invalid service name {name!r}: use letters, digits, '.', '_' or '-' "
+                         f"(starting with a letter or digit, at most 63 characters)")
+    return normalized
+
+
+BASE_PATH_RE = re.compile(r"^(/[A-Za-z0-9._~-]+)*$")
+
+
+def normalize_base_path(value: Any) -> str:
+    """规范化反向代理子路径：补全前导 /、去掉末尾 /，根路径为空字符串"""
+    path = "/" + str(value or "").strip().strip("/")
+    path = "" if path == "/" else path
+    if not BASE_PATH_RE.match(path):
+        raise ValueError(f"invalid server.basePath: {value!r}")
+    return path
+
+
+def is_loopback(host: str) -> bool:
+    """是否仅监听本机回环地址"""
+    if host == "localhost":
+        return True
+    try:
+        return ipaddress.ip_address(host).is_loopback
+    except ValueError:
+        return False
+
+
+def parse_duration(value: Any, default: float) -> float:
+    """解析时长（秒数或 "500ms"/"30s"/"5m"/"1h"），返回秒"""
+    if value is None or value == "":
+        return default
+    if isinstance(value, (int, float)) and not isinstance(value, bool):
+        return float(value)
+    m = DURATION_RE.match(str(value).strip())
+    if not m:
+        raise ValueError(f"invalid duration: {value}")
+    return float(m.group(1)) * DURATION_UNITS[m.group(2) or "s"]
+
+
+# CORS 预检默认允许的请求头
+DEFAULT_CORS_HEADERS = ("Content-Type", "Authorization", "X-API-Key", "X-Request-ID", "X-MCP-Timeout")
+
+
+# 日志/历史中需要脱敏的参数名（不区分大小写，包含即匹配）
+DEFAULT_REDACT_KEYS = ("password", "secret", "token", "apikey", "api_key", "authorization")
+
+
+def redact(value: Any, keys: List[str]) -> Any:
+    """递归替换敏感字段的值"""
+    if isinstance(value, dict):
+        return {
+            k: "***" if any(r.lower() in str(k).lower() for r in keys) else redact(v, keys)
+            for k, v in value.items()
+        }
+    if isinstance(value, list):
+        return [redact(v, keys) for v in value]
+    return value
+
+
+# stdio 消息分帧：按行分隔的 JSON，或 LSP 风格的 Content-Length 头
+FRAMING_NEWLINE = "newline"
+FRAMING_CONTENT_LENGTH = "contentLength"
+FRAMINGS = (FRAMING_NEWLINE, FRAMING_CONTENT_LENGTH)
+
+
+def read_framed(stream) -> Optional[bytes]:
+    """读取一条 Content-Length 分帧消息；流结束返回 None（跳过头部之前的非头部行）"""
+    length = None
+    while True:
+        line = stream.readline()
+        if not line:
+            return None
+        header = line.strip()
+        if not header:
+            if length is not None:
+                break
+            continue
+        name, sep, value = header.partition(b":")
+        if sep and name.strip().lower() == b"content-length":
+            try:
+                length = int(value.strip())
+            except ValueError:
+                length = None
+    
+    body = b""
+    while len(body) < length:
+        chunk = stream.read(length - len(body))
+        if not chunk:
+            return None
+        body += chunk
+    return body
+
+
+def encode_frame(data: dict, framing: str) -> bytes:
+    """按分帧方式编码一条消息"""
+    body = json.dumps(data).encode()
+    if framing == FRAMING_CONTENT_LENGTH:
+        return b"Content-Length: %d\r\n\r\n" % len(body) + body
+    return body + b"\n"
+
+
+# 不继承网关环境时仍透传的基础变量（运行时查找命令、缓存目录等所需）
+BASE_ENV_KEYS = ("PATH", "HOME", "USER", "LANG", "LC_ALL", "TMPDIR", "TZ", "SYSTEMROOT")
+
+ENV_KEY_RE = re.compile(r"^[A-Za-z_][A-Za-z0-9_.]*$")
+ENV_ESCAPES = {"n": "\n", "r": "\r", "t": "\t", '"': '"', "\\": "\\", "$": "$"}
+
+
+def parse_env_value(raw: str) -> str:
+    """解析 .env 的值：双引号支持转义，单引号按字面量，未加引号时去掉行尾 # 注释"""
+    raw = raw.strip()
+    if raw[:1] in ('"', "'"):
+        quote, out, i = raw[0], [], 1
+        while i < len(raw):
+            c = raw[i]
+            if c == "\\" and quote == '"' and i + 1 < len(raw):
+                out.append(ENV_ESCAPES.get(raw[i + 1], "\\" + raw[i + 1]))
+                i += 2
+                continue
+            if c == quote:
+                return "".join(out)
+            out.append(c)
+            i += 1
+        raise ValueError("unterminated quoted value")
+    
+    comment = raw.find(" #")
+    if comment >= 0:
+        raw = raw[:comment]
+    return raw.strip()
+
+
+def load_env_file(path: str) -> Dict[str, str]:
+    """读取 .env 文件，返回变量字典（不修改当前进程环境）"""
+    values = {}
+    with open(path, encoding="utf-8") as f:
+        for lineno, line in enumerate(f, 1):
+            line = line.strip()
+            if not line or line.startswith("#"):
+                continue
+            if line.startswith("export "):
+                line = line[len("export "):].lstrip()
+            if "=" not in line:
+                continue
+            
+            key, value = line.split("=", 1)
+            key = key.strip()
+            if not ENV_KEY_RE.match(key):
+                raise ValueError(f"{path}:{lineno}: invalid variable name {key!r}")
+            try:
+                values[key] = parse_env_value(value)
+            except ValueError as e:
+                raise ValueError(f"{path}:{lineno}: {key}: {e}")
+    return values
+
+
+# 常见运行时及安装提示
+RUNTIME_HINTS = {
+    "uvx": "install uv (https://docs.astral.sh/uv/) so that uvx is on PATH",
+    "npx": "install Node.js (https://nodejs.org/) so that npx is on PATH",
+    "docker": "install Docker and make sure the docker CLI is on PATH",
+}
+
+
+# 当前 HTTP 请求的关联 ID（X-Request-ID），用于日志与转发给 MCP 服务
+REQUEST_ID: contextvars.ContextVar[str] = contextvars.ContextVar("request_id", default="")
+REQUEST_ID_RE = re.compile(r"^[A-Za-z0-9._:-]{1,128}$")
+# 当前工具调用的分阶段耗时（秒），由 call_tool 设置，_call/_request 写入
+CALL_TIMINGS: contextvars.ContextVar[Optional[dict]] = contextvars.ContextVar("call_timings", default=None)
+
+
+def log(message: str) -> None:
+    """输出日志；处理 HTTP 请求期间附带请求关联 ID"""
+    request_id = REQUEST_ID.get()
+    print(f"[{request_id}] {message}" if request_id else message)
+
+
+def error_response(exc_class, code: str, message: str, headers: Optional[dict] = None, **extra):
+    """构造带结构化 JSON 错误体的 HTTP 异常"""
+    body = {"success": False, "errorCode": code, "message": message}
+    body.update(extra)
+    return exc_class(text=json.dumps(body, ensure_ascii=False), content_type="application/json",
+                     headers=headers)
+
+
+def error_message(exc: web.HTTPException) -> str:
+    """HTTP 异常的错误信息（结构化错误体取 message）"""
+    if exc.content_type == "application/json":
+        try:
+            return json.loads(exc.text).get("message") or exc.text
+        except (ValueError, AttributeError):
+            pass
+    return exc.text
+
+
+def service_not_found(name: str) -> web.HTTPException:
+    return error_response(web.HTTPNotFound, "SERVICE_NOT_FOUND", f"Service {name} not found", service=name)
+
+
+def service_not_running(name: str, exc_class=web.HTTPConflict) -> web.HTTPException:
+    return error_response(exc_class, "NOT_RUNNING", f"Service {name} not running", service=name)
 
 
 # ==================== 数据模型 ====================
 
+@dataclass
+class ServerConfig:
+    host: str = DEFAULT_HOST
+    shutdown_timeout: float = 30.0
+    health_check_interval: float = 30.0
+    api_keys: List[str] = field(default_factory=list)
+    api_key_names: Dict[str, str] = field(default_factory=dict, repr=False)
+    require_auth_for_public_bind: bool = False
+    read_only: bool = False
+    history_size: int = 50
+    redact_keys: List[str] = field(default_factory=lambda: list(DEFAULT_REDACT_KEYS))
+    max_concurrent_starts: int = 4
+    keep_alive_timeout: float = 75.0
+    request_timeout: float = 0.0
+    max_body_size: int = 1024 * 1024
+    max_concurrent_requests: int = 0
+    max_call_timeout: float = 300.0
+    max_concurrent_calls: int = 0
+    base_path: str = ""
+    public_url: str = ""
+    trusted_proxies: List[Any] = field(default_factory=list)
+    skills_dir: str = os.path.join(BASE_DIR, "skills")
+
+
+@dataclass
+class WebConfig:
+    poll_interval: float = 30.0
+
+
+@dataclass
+class HTTPClientConfig:
+    """网关对外 HTTP 请求（健康检查、sampling webhook）共用的连接池"""
+    max_connections: int = 100
+    max_connections_per_host: int = 10
+    keep_alive: float = 30.0
+
+
+@dataclass
+class SecurityConfig:
+    """可启动命令的白名单（glob，匹配命令名或解析后的完整路径）；为空时不限制"""
+    allowed_commands: List[str] = field(default_factory=list)
+    
+    def command_allowed(self, command: str) -> bool:
+        if not self.allowed_commands:
+            return True
+        candidates = {command, os.path.basename(command), shutil.which(command) or command}
+        return any(fnmatch.fnmatchcase(c, p) for c in candidates for p in self.allowed_commands)
+
+
+@dataclass
+class CorsConfig:
+    """跨域访问：allowed_origins 为空时不返回任何 CORS 响应头"""
+    allowed_origins: List[str] = field(default_factory=list)
+    allowed_methods: List[str] = field(default_factory=lambda: ["GET", "POST"])
+    allowed_headers: List[str] = field(default_factory=lambda: list(DEFAULT_CORS_HEADERS))
+    max_age: float = 600.0
+    
+    def origin_allowed(self, origin: str) -> bool:
+        return bool(origin) and ("*" in self.allowed_origins or origin in self.allowed_origins)
+
+
+@dataclass
+class SamplingConfig:
+    """sampling/createMessage 回调：转发到 webhook，响应体即 CreateMessageResult"""
+    url: str
+    timeout: float = 60.0
+
+
+@dataclass
+class HealthCheckConfig:
+    url: str
+    timeout: float = 5.0
+    unhealthy_threshold: int = 3
+
+
+@dataclass
+class OverrideConfig:
+    """调用方可按次覆盖的启动参数（参数化实例）"""
+    env: List[str] = field(default_factory=list)    # 可设置的环境变量名
+    args: List[str] = field(default_factory=list)   # 可设置取值的参数，以 "<flag> <value>" 追加到 args 末尾
+    max_instances: int = 4
+
+
+@dataclass
+class ToolConfig:
+    name: str
+    defaults: Dict[str, Any] = field(default_factory=dict)
+    read_only: bool = False
+    timeout: float = 0.0
+
+
 @dataclass
 class MCPService:
     name: str
@@ -35,6 +400,83 @@ class MCPService:
     env: List[Dict[str, str]]
     port: int
     enabled: bool
+    tools: Dict[str, ToolConfig] = field(default_factory=dict)
+    ephemeral: bool = False
+    pool_size: int = 0
+    health_check: Optional[HealthCheckConfig] = None
+    roots: List[dict] = field(default_factory=list)
+    allow_tools: List[str] = field(default_factory=list)
+    deny_tools: List[str] = field(default_factory=list)
+    env_files: List[str] = field(default_factory=list)
+    inherit_env: bool = False
+    framing: str = FRAMING_NEWLINE
+    auto_restart_on_change: bool = False
+    max_lifetime: float = 0.0
+    alias_of: str = ""
+    timeout: float = 0.0
+    init_timeout: float = INIT_TIMEOUT
+    init_retries: int = INIT_RETRIES
+    overridable: Optional[OverrideConfig] = None
+    headers: Dict[str, str] = field(default_factory=dict, repr=False)
+    validate_results: str = VALIDATE_OFF
+    forward_caller: bool = False
+    reauth_tool: str = ""
+    rate_limit: float = 0.0
+    max_concurrency: int = 0
+    queue_depth: int = 100
+    labels: Dict[str, str] = field(default_factory=dict)
+    tags: List[str] = field(default_factory=list)
+    container: str = ""
+    start_on_boot: bool = True
+    lenient_json: bool = False
+    client_capabilities: Dict[str, Any] = field(default_factory=dict)
+    
+    @property
+    def executable(self) -> str:
+        """宿主机上实际执行的程序（exec 模式为 docker）"""
+        return "docker" if self.container else self.command
+    
+    def argv(self) -> List[str]:
+        """启动命令；exec 模式通过 docker exec -i 在已运行的容器中执行，env 以 -e 透传"""
+        if not self.container:
+            return [self.command] + self.args
+        env_flags = []
+        for e in self.env:
+            if e.get("name"):
+                env_flags += ["-e", e["name"]]
+        return ["docker", "exec", "-i", *env_flags, self.container, self.command] + self.args
+    
+    def launch_spec(self) -> dict:
+        """影响进程启动的配置；变化后需重启才能生效"""
+        return {
+            "command": self.command,
+            "args": self.args,
+            "env": self.env,
+            "envFile": self.env_files,
+            "inheritEnv": self.inherit_env,
+            "framing": self.framing,
+            "container": self.container,
+            "clientCapabilities": self.client_capabilities,
+            "ephemeral": self.ephemeral,
+            "poolSize": self.pool_size,
+            "overridable": self.overridable,
+        }
+
+
+@dataclass
+class CallContext:
+    """单次调用的请求上下文（供参数模板使用）"""
+    api_key: str = ""
+    timeout: float = 0.0  # X-MCP-Timeout 指定的调用超时（已按上限截断），0 表示使用配置
+    overrides: Optional[dict] = None  # 已校验的启动参数覆盖，非空时调用路由到对应的参数化实例
+
+
+@dataclass
+class HealthState:
+    healthy: bool = True
+    failures: int = 0
+    last_checked: float = 0.0
+    last_error: str = ""
 
 
 @dataclass
@@ -42,7 +484,486 @@ class RunningMCP:
     process: subprocess.Popen
     port: int
     started_at: float
-    request_id: int = 2
+    request_id: int = 1
+    name: str = ""
+    framing: str = FRAMING_NEWLINE
+    stdout_noise: int = 0
+    json_repairs: int = 0
+    # (时间戳, 行)
+    stderr: Deque[tuple] = field(default_factory=lambda: deque(maxlen=STDERR_TAIL_LINES), repr=False)
+    busy: int = 0
+    lock: asyncio.Lock = field(default_factory=asyncio.Lock, repr=False)
+    write_lock: asyncio.Lock = field(default_factory=asyncio.Lock, repr=False)
+    # initialize 响应与 notifications/initialized 均完成后置位
+    ready: asyncio.Event = field(default_factory=asyncio.Event, repr=False)
+    pending: Dict[int, asyncio.Future] = field(default_factory=dict, repr=False)
+    # 响应到达时间（读取线程读完一条消息时），供分阶段耗时统计
+    arrivals: Dict[int, float] = field(default_factory=dict, repr=False)
+    capabilities: Dict[str, Any] = field(default_factory=dict)
+    # initialize 响应的原始 result（含服务端的非标准字段），供排查使用
+    initialize_result: Dict[str, Any] = field(default_factory=dict, repr=False)
+    env: Dict[str, str] = field(default_factory=dict, repr=False)
+
+
+class MCPError(Exception):
+    """MCP 服务返回的 JSON-RPC 错误（error 为 {code, message, data} 或描述字符串）"""
+    
+    def __init__(self, error: Any):
+        super().__init__(str(error))
+        self.error = error
+    
+    @property
+    def code(self) -> Optional[int]:
+        return self.error.get("code") if isinstance(self.error, dict) else None
+    
+    @property
+    def message(self) -> str:
+        if isinstance(self.error, dict):
+            return str(self.error.get("message", ""))
+        return str(self.error)
+    
+    @property
+    def data(self) -> Any:
+        return self.error.get("data") if isinstance(self.error, dict) else None
+    
+    def response(self, exc_class, message: str) -> web.HTTPException:
+        """转换为结构化的 HTTP 错误（errorCode MCP_ERROR，附带原始 JSON-RPC 错误）"""
+        return error_response(exc_class, "MCP_ERROR", message,
+                              mcpError={"code": self.code, "message": self.message, "data": self.data})
+
+
+# ==================== 事件广播 ====================
+
+# 服务生命周期事件与工具调用事件（tool_called / tool_failed，每次调用一条）
+LIFECYCLE_EVENTS = frozenset({"starting", "started", "stopped", "exited", "restarted",
+                              "healthy", "unhealthy", "startup"})
+TOOL_EVENTS = frozenset({"tool_called", "tool_failed"})
+# 服务端通知工具列表变化（notifications/tools/list_changed）后刷新缓存并推送新的工具名列表
+CATALOG_EVENTS = frozenset({"tools_changed"})
+
+
+class EventHub:
+    """服务状态事件广播：每个订阅者一个有界队列，满了直接丢弃，不阻塞发布方"""
+    
+    def __init__(self, queue_size: int = 100):
+        self.queue_size = queue_size
+        self.subscribers: Dict[asyncio.Queue, Optional[frozenset]] = {}
+    
+    def subscribe(self, events: Optional[frozenset] = None) -> asyncio.Queue:
+        """订阅事件；events 为 None 时接收全部类型"""
+        queue = asyncio.Queue(maxsize=self.queue_size)
+        self.subscribers[queue] = events
+        return queue
+    
+    def unsubscribe(self, queue: asyncio.Queue) -> None:
+        self.subscribers.pop(queue, None)
+    
+    def publish(self, event: str, service: str, **data) -> None:
+        message = {"event": event, "service": service, "time": time.time(), **data}
+        for queue, events in list(self.subscribers.items()):
+            if events is not None and event not in events:
+                continue
+            try:
+                queue.put_nowait(message)
+            except asyncio.QueueFull:
+                pass
+
+
+class ServiceLimiter:
+    """单个服务的上游配额：令牌桶限速 + 并发上限，排队超过 queueDepth 时拒绝"""
+    
+    def __init__(self, rate: float, max_concurrency: int, queue_depth: int):
+        self.rate = rate
+        self.max_concurrency = max_concurrency
+        self.queue_depth = queue_depth
+        self.tokens = max(rate, 1.0)
+        self.updated = time.monotonic()
+        self.slots = asyncio.Semaphore(max_concurrency) if max_concurrency > 0 else None
+        self.waiting = 0
+        self.active = 0
+    
+    async def acquire(self, name: str) -> None:
+        if self.waiting >= self.queue_depth:
+            raise error_response(
+                web.HTTPTooManyRequests, "RATE_LIMITED",
+                f"Service {name} is at its rate/concurrency limit and the queue is full",
+                queueDepth=self.queue_depth
+            )
+        self.waiting += 1
+        try:
+            while self.rate > 0:
+                now = time.monotonic()
+                self.tokens = min(max(self.rate, 1.0), self.tokens + (now - self.updated) * self.rate)
+                self.updated = now
+                if self.tokens >= 1:
+                    self.tokens -= 1
+                    break
+                await asyncio.sleep((1 - self.tokens) / self.rate)
+            if self.slots:
+                await self.slots.acquire()
+        finally:
+            self.waiting -= 1
+        self.active += 1
+    
+    def release(self) -> None:
+        self.active -= 1
+        if self.slots:
+            self.slots.release()
+    
+    def stats(self) -> dict:
+        return {
+            "rateLimit": self.rate or None,
+            "maxConcurrency": self.max_concurrency or None,
+            "active": self.active,
+            "waiting": self.waiting,
+            "queueDepth": self.queue_depth,
+        }
+
+
+class LatencyHistogram:
+    """调用耗时直方图（按服务与阶段），以 Prometheus 文本格式导出"""
+    
+    BUCKETS = (0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0, 30.0, 60.0)
+    
+    def __init__(self):
+        # (service, phase) -> [各桶计数..., 总和, 次数]
+        self.series: Dict[tuple, list] = {}
+    
+    def observe(self, service: str, phase: str, seconds: float) -> None:
+        values = self.series.setdefault((service, phase), [0] * len(self.BUCKETS) + [0.0, 0])
+        for i, bound in enumerate(self.BUCKETS):
+            if seconds <= bound:
+                values[i] += 1
+        values[-2] += seconds
+        values[-1] += 1
+    
+    def render(self, metric: str) -> str:
+        lines = [f"# HELP {metric} Tool call latency by phase (queue, write, server, read, total).",
+                 f"# TYPE {metric} histogram"]
+        for (service, phase), values in sorted(self.series.items()):
+            labels = f'service="{prometheus_escape(service)}",phase="{phase}"'
+            for bound, count in zip(self.BUCKETS, values):
+                lines.append(f'{metric}_bucket{{{labels},le="{bound:g}"}} {count}')
+            lines.append(f'{metric}_bucket{{{labels},le="+Inf"}} {values[-1]}')
+            lines.append(f"{metric}_sum{{{labels}}} {values[-2]:.6f}")
+            lines.append(f"{metric}_count{{{labels}}} {values[-1]}")
+        return "\n".join(lines) + "\n"
+
+
+def prometheus_escape(value: str) -> str:
+    return value.replace("\\", "\\\\").replace('"', '\\"').replace("\n", "\\n")
+
+
+# ==================== 参数校验 ====================
+
+JSON_TYPES = {
+    "object": dict,
+    "array": list,
+    "string": str,
+    "integer": int,
+    "number": (int, float),
+    "boolean": bool,
+    "null": type(None),
+}
+
+
+def validate_arguments(schema: dict, value: Any, path: str = "arguments") -> List[str]:
+    """按 JSON Schema 校验参数（支持 type/required/properties/enum/items 子集）"""
+    errors = []
+    if not isinstance(schema, dict):
+        return errors
+    
+    expected = schema.get("type")
+    if expected:
+        types = expected if isinstance(expected, list) else [expected]
+        ok = False
+        for t in types:
+            py_type = JSON_TYPES.get(t)
+            if py_type is None:
+                ok = True
+                break
+            # bool 是 int 的子类，需单独排除
+            if isinstance(value, bool) and t in ("integer", "number"):
+                continue
+            if isinstance(value, py_type):
+                ok = True
+                break
+        if not ok:
+            return [f"{path}: expected {'/'.join(types)}"]
+    
+    if "enum" in schema and value not in schema["enum"]:
+        errors.append(f"{path}: must be one of {schema['enum']}")
+    
+    if isinstance(value, dict):
+        for key in schema.get("required", []):
+            if key not in value:
+                errors.append(f"{path}.{key}: is required")
+        for key, sub in schema.get("properties", {}).items():
+            if key in value:
+                errors.extend(validate_arguments(sub, value[key], f"{path}.{key}"))
+    
+    if isinstance(value, list) and isinstance(schema.get("items"), dict):
+        for i, item in enumerate(value):
+            errors.extend(validate_arguments(schema["items"], item, f"{path}[{i}]"))
+    
+    return errors
+
+
+# ==================== 工具注解 ====================
+
+def tool_hints(tool: Optional[dict]) -> dict:
+    """工具注解（MCP annotations），缺失时按规范取保守默认值：非只读、具破坏性、非幂等、开放世界"""
+    annotations = (tool or {}).get("annotations") or {}
+    read_only = annotations.get("readOnlyHint") is True
+    return {
+        "readOnlyHint": read_only,
+        # 只读工具不会有破坏性；其余未声明时视为具破坏性
+        "destructiveHint": False if read_only else annotations.get("destructiveHint", True) is not False,
+        "idempotentHint": annotations.get("idempotentHint") is True,
+        "openWorldHint": annotations.get("openWorldHint", True) is not False,
+    }
+
+
+# ==================== 结果筛选 ====================
+
+# JSONPath 子集：$.a.b、[0]、[-1]、[*]、['key']；表达式长度与段数有上限
+SELECT_TOKEN_RE = re.compile(r"\.([A-Za-z_][A-Za-z0-9_-]*)|\[(-?\d+|\*)\]|\[\'([^\']*)\'\]|\.\*")
+SELECT_MAX_LENGTH = 256
+SELECT_MAX_SEGMENTS = 32
+
+
+def parse_select(expr: str) -> List[Any]:
+    """解析筛选表达式为路径段；"*" 表示通配"""
+    if len(expr) > SELECT_MAX_LENGTH:
+        raise ValueError(f"expression longer than {SELECT_MAX_LENGTH} characters")
+    if not expr.startswith("$"):
+        raise ValueError("expression must start with $")
+    segments, pos = [], 1
+    while pos < len(expr):
+        m = SELECT_TOKEN_RE.match(expr, pos)
+        if not m:
+            raise ValueError(f"unexpected {expr[pos:pos + 10]!r} at position {pos}")
+        name, index, quoted = m.groups()
+        if index is not None:
+            segments.append("*" if index == "*" else int(index))
+        elif name is not None or quoted is not None:
+            segments.append(name if name is not None else quoted)
+        else:
+            segments.append("*")
+        pos = m.end()
+    if len(segments) > SELECT_MAX_SEGMENTS:
+        raise ValueError(f"expression has more than {SELECT_MAX_SEGMENTS} segments")
+    return segments
+
+
+def select_path(value: Any, segments: List[Any]) -> Any:
+    """按路径段取值；通配返回列表，缺失的路径为 None"""
+    for i, seg in enumerate(segments):
+        if seg == "*":
+            items = value.values() if isinstance(value, dict) else value if isinstance(value, list) else []
+            return [select_path(item, segments[i + 1:]) for item in items]
+        if isinstance(seg, int):
+            if not isinstance(value, list) or not -len(value) <= seg < len(value):
+                return None
+            value = value[seg]
+        elif isinstance(value, dict):
+            value = value.get(seg)
+        else:
+            return None
+    return value
+
+
+# ==================== 参数模板 ====================
+
+# 仅支持 {{.now}} / {{.date}} / {{.service}} / {{.tool}} / {{.caller}} / {{env "X"}}
+# {{.caller}} 为调用方身份（API Key 的 name 或摘要），不向 MCP 服务暴露 Key 本身
+TEMPLATE_RE = re.compile(r"\{\{\s*(.*?)\s*\}\}")
+TEMPLATE_ENV_RE = re.compile(r'^env\s+"([A-Za-z_][A-Za-z0-9_]*)"$')
+TEMPLATE_VARS = ("now", "date", "service", "tool", "caller")
+
+
+def _template_expr(expr: str, values: Optional[dict]) -> str:
+    m = TEMPLATE_ENV_RE.match(expr)
+    if m:
+        return os.environ.get(m.group(1), "") if values is not None else ""
+    if expr.startswith(".") and expr[1:] in TEMPLATE_VARS:
+        return str(values.get(expr[1:], "")) if values is not None else ""
+    if expr == ".apiKey":
+        raise ValueError("{{.apiKey}} is not supported (it would forward the gateway credential): "
+                         "use {{.caller}} for the caller identity")
+    raise ValueError(f"unsupported template expression: {{{{{expr}}}}}")
+
+
+# defaults 中不适用于所有服务的字段
+SERVICE_ONLY_KEYS = ("name", "displayName", "description", "aliasOf", "port")
+
+
+def apply_defaults(defaults: dict, svc: dict) -> dict:
+    """将顶层 defaults 合并到服务配置：服务自身的值优先，env 按 name、headers/clientCapabilities 按键合并"""
+    merged = {k: v for k, v in defaults.items() if k not in SERVICE_ONLY_KEYS}
+    merged.update(svc)
+    if "env" in defaults and "env" in svc:
+        names = {e.get("name") for e in svc["env"] or []}
+        merged["env"] = [e for e in defaults["env"] or [] if e.get("name") not in names] + list(svc["env"] or [])
+    if "headers" in defaults and "headers" in svc:
+        merged["headers"] = {**(defaults["headers"] or {}), **(svc["headers"] or {})}
+    if isinstance(defaults.get("clientCapabilities"), dict) and isinstance(svc.get("clientCapabilities"), dict):
+        merged["clientCapabilities"] = {**defaults["clientCapabilities"], **svc["clientCapabilities"]}
+    return merged
+
+
+def resolve_value(item: Any) -> str:
+    """解析配置值：字符串，或 {value}/{valueFrom: env:X}（从网关环境读取）"""
+    if not isinstance(item, dict):
+        return str(item)
+    value = item.get("value", "")
+    value_from = item.get("valueFrom", "")
+    if not value and value_from.startswith("env:"):
+        value = os.environ.get(value_from[4:], "")
+    return value
+
+
+# args 中的引用：${VAR} / ${env:VAR} 取网关环境变量，${file:/path} 读取文件（如挂载的密钥），$${...} 保留原文
+ARG_REF_RE = re.compile(r"\$(\$?)\{(?:(env|file):)?([^}]*)\}")
+
+
+def expand_args(args: List[str]) -> List[str]:
+    """展开 args 中的环境变量/文件引用；引用无法解析时抛出 ValueError（不启动进程）"""
+    def expand(m: re.Match) -> str:
+        escaped, source, ref = m.groups()
+        if escaped:
+            return m.group(0)[1:]
+        if source == "file":
+            try:
+                with open(ref) as f:
+                    return f.read().strip()
+            except OSError as e:
+                raise ValueError(f"{m.group(0)}: cannot read {ref}: {e.strerror}")
+        if ref not in os.environ:
+            raise ValueError(f"{m.group(0)}: environment variable {ref} is not set")
+        return os.environ[ref]
+    return [ARG_REF_RE.sub(expand, str(arg)) for arg in args]
+
+
+NONFINITE_RE = re.compile(r"-?Infinity|NaN")
+
+
+def reject_constant(name: str) -> None:
+    raise ValueError(f"non-standard JSON constant {name}")
+
+
+def repair_json(text: str) -> str:
+    """宽松解析的修复：去掉对象/数组末尾多余的逗号，NaN/Infinity 替换为 null（不改动字符串内容）"""
+    out, i, n = [], 0, len(text)
+    while i < n:
+        c = text[i]
+        if c == '"':
+            j = i + 1
+            while j < n and text[j] != '"':
+                j += 2 if text[j] == "\\" else 1
+            out.append(text[i:j + 1])
+            i = j + 1
+            continue
+        if c == ",":
+            j = i + 1
+            while j < n and text[j] in " \t\r\n":
+                j += 1
+            if j < n and text[j] in "}]":
+                i = j
+                continue
+        m = NONFINITE_RE.match(text, i)
+        if m:
+            out.append("null")
+            i = m.end()
+            continue
+        out.append(c)
+        i += 1
+    return "".join(out)
+
+
+def content_blob(block: Any) -> Optional[tuple]:
+    """内容块中的二进制数据：image/audio 的 data 或嵌入资源的 blob，返回 (base64, mimeType)"""
+    if not isinstance(block, dict):
+        return None
+    if block.get("type") in ("image", "audio") and block.get("data"):
+        return block["data"], block.get("mimeType") or "application/octet-stream"
+    resource = block.get("resource")
+    if block.get("type") == "resource" and isinstance(resource, dict) and resource.get("blob"):
+        return resource["blob"], resource.get("mimeType") or "application/octet-stream"
+    return None
+
+
+# 附件文件名（Content-Disposition 的 filename）允许的字符，其余替换为 _
+FILENAME_UNSAFE_RE = re.compile(r"[^A-Za-z0-9._-]")
+
+
+def content_disposition(uri: str, fallback: str) -> str:
+    """附件下载头：文件名取自服务端提供的 URI，filename 只保留安全字符，原名以 filename* 百分号编码附带"""
+    name = os.path.basename(urllib.parse.urlsplit(uri).path.rstrip("/"))
+    safe = FILENAME_UNSAFE_RE.sub("_", name).strip(".")
+    if not safe:
+        return f'attachment; filename="{fallback}"'
+    if safe == name:
+        return f'attachment; filename="{safe}"'
+    return f"attachment; filename=\"{safe}\"; filename*=UTF-8''{urllib.parse.quote(name, safe='')}"
+
+
+RESULT_MODES = ("auto", "raw", "structured", "text")
+
+
+def shape_result(result: Any, mode: str, output_schema: bool = False) -> tuple:
+    """按 resultMode 转换调用结果，返回 (结果, 附加字段)：
+    auto 在工具声明了 outputSchema（output_schema）且结果带 structuredContent 时返回 structuredContent，否则原样返回，
+    resultBasis 说明判断依据（initialize 的 capabilities 中没有结构化输出的声明，不作为依据）；raw 始终原样返回；
+    structured 优先取 structuredContent，其次解析 JSON 文本，都没有时原样返回并标记 degraded；
+    text 拼接文本内容块，没有文本时序列化 structuredContent"""
+    if mode == "raw" or not isinstance(result, dict):
+        return result, {}
+    if mode == "auto":
+        if output_schema and "structuredContent" in result:
+            return result["structuredContent"], {"resultMode": "structured", "resultBasis": "outputSchema"}
+        return result, {"resultBasis": "outputSchema" if output_schema else "none"}
+    content = result.get("content") if isinstance(result.get("content"), list) else []
+    texts = [b.get("text", "") for b in content if isinstance(b, dict) and b.get("type") == "text"]
+    
+    if mode == "structured":
+        if "structuredContent" in result:
+            return result["structuredContent"], {"structuredSource": "structuredContent"}
+        if len(texts) == 1:
+            try:
+                return json.loads(texts[0]), {"structuredSource": "text"}
+            except ValueError:
+                pass
+        return result, {"degraded": True,
+                        "degradedReason": "result has no structuredContent and its text is not JSON"}
+    
+    if texts:
+        return "\n".join(texts), {}
+    if "structuredContent" in result:
+        return json.dumps(result["structuredContent"], ensure_ascii=False), {"textSource": "structuredContent"}
+    return "", {"degraded": True, "degradedReason": "result has no text content"}
+
+
+def render_template(value: Any, values: Optional[dict]) -> Any:
+    """渲染参数模板；values 为 None 时只做语法检查"""
+    if isinstance(value, str):
+        return TEMPLATE_RE.sub(lambda m: _template_expr(m.group(1), values), value)
+    if isinstance(value, dict):
+        return {k: render_template(v, values) for k, v in value.items()}
+    if isinstance(value, list):
+        return [render_template(v, values) for v in value]
+    return value
+
+
+def merge_arguments(defaults: dict, arguments: dict) -> dict:
+    """将默认参数合并到调用参数之下（调用方的值优先）"""
+    merged = dict(defaults)
+    for key, value in arguments.items():
+        if isinstance(value, dict) and isinstance(merged.get(key), dict):
+            merged[key] = merge_arguments(merged[key], value)
+        else:
+            merged[key] = value
+    return merged
 
 
 # ==================== MCP 管理器 ====================
@@ -52,21 +973,129 @@ class MCPManager:
     
     def __init__(self):
         self.config: Dict[str, MCPService] = {}
+        self.server = ServerConfig(host=HOST or DEFAULT_HOST)
+        self.runtimes: Dict[str, bool] = {}
+        self.health: Dict[str, HealthState] = {}
+        self.sampling: Optional[SamplingConfig] = None
+        self.security = SecurityConfig()
+        self.cors = CorsConfig()
+        self.http_client = HTTPClientConfig()
+        self.http: Optional[aiohttp.ClientSession] = None
+        self.web = WebConfig()
+        self.events = EventHub()
+        self.history: Dict[str, Deque[dict]] = {}
+        self.config_path = ""
+        self.drift: set = set()
+        self.start_errors: Dict[str, str] = {}
+        self.start_slots: Optional[asyncio.Semaphore] = asyncio.Semaphore(self.server.max_concurrent_starts)
+        self.configured_count = 0
         self.running: Dict[str, RunningMCP] = {}
+        self.pools: Dict[str, List[RunningMCP]] = {}
+        # 启动中（含排队等待启动槽位）的服务，可被 stop_service 取消
+        self.starting: Dict[str, asyncio.Task] = {}
+        # 参数化实例：服务名 → {覆盖参数键: 进程}，按最近使用排序
+        self.instances: Dict[str, Dict[str, RunningMCP]] = {}
+        # 启动中的参数化实例：(服务名, 覆盖参数键) → 启动任务，同一组参数的并发调用共享一次启动
+        self.instance_starts: Dict[tuple, asyncio.Task] = {}
+        # 临时模式补充预热进程的任务：每个服务同时只有一个，避免并发补充超出 poolSize
+        self.refills: Dict[str, asyncio.Task] = {}
+        self.tools: Dict[str, List[dict]] = {}
+        self.tool_fetches: Dict[str, asyncio.Future] = {}
+        self.limiters: Dict[str, ServiceLimiter] = {}
+        self.active_requests = 0
+        self.active_calls = 0
+        self.call_counts: Dict[str, int] = {}
+        self.last_call_at: Dict[str, float] = {}
+        self.results: Dict[str, tuple] = {}
+        self.latency = LatencyHistogram()
     
     def load_config(self, path: str) -> None:
-        """加载配置"""
+        """加载配置：先完整解析并校验新配置，全部通过后才替换当前配置（出错时保留当前配置不变）"""
         if not os.path.exists(path):
-            print(f"Config not found: {path}")
+            log(f"Config not found: {path}")
             return
         
         with open(path) as f:
             data = yaml.safe_load(f)
         
-        self.config.clear()
-        for svc in data.get("mcp", {}).get("enabled", []):
+        # 规范化服务名并检查重名
+        entries = []
+        seen = {}
+        for svc in data.get("mcp", {}).get("enabled", []) or []:
+            raw = svc.get("name")
+            name = normalize_service_name(raw)
+            if name in seen:
+                raise ValueError(f"duplicate service name {raw!r} (conflicts with {seen[name]!r})")
+            seen[name] = raw
+            svc = dict(svc, name=name)
+            if svc.get("aliasOf"):
+                svc["aliasOf"] = normalize_service_name(svc["aliasOf"])
+            entries.append(svc)
+        
+        server_cfg = data.get("server", {}) or {}
+        server = ServerConfig(
+            host=validate_host(HOST or server_cfg.get("host") or DEFAULT_HOST),
+            shutdown_timeout=parse_duration(server_cfg.get("shutdownTimeout"), 30.0),
+            health_check_interval=parse_duration(server_cfg.get("healthCheckInterval"), 30.0),
+            api_keys=self._load_api_keys(server_cfg.get("apiKeys", [])),
+            api_key_names={resolve_value(k): k["name"] for k in server_cfg.get("apiKeys", []) or []
+                           if isinstance(k, dict) and k.get("name") and resolve_value(k)},
+            require_auth_for_public_bind=bool(server_cfg.get("requireAuthForPublicBind", False)),
+            read_only=bool(server_cfg.get("readOnly", False)),
+            history_size=int(server_cfg.get("historySize", 50)),
+            redact_keys=server_cfg.get("redactKeys") or list(DEFAULT_REDACT_KEYS),
+            max_concurrent_starts=int(server_cfg.get("maxConcurrentStarts", 4)),
+            keep_alive_timeout=parse_duration(server_cfg.get("keepAliveTimeout"), 75.0),
+            request_timeout=parse_duration(server_cfg.get("requestTimeout"), 0.0),
+            max_body_size=int(server_cfg.get("maxBodySize", 1024 * 1024)),
+            max_concurrent_requests=int(server_cfg.get("maxConcurrentRequests", 0)),
+            max_call_timeout=parse_duration(server_cfg.get("maxCallTimeout"), 300.0),
+            max_concurrent_calls=int(server_cfg.get("maxConcurrentCalls", 0)),
+            base_path=normalize_base_path(server_cfg.get("basePath")),
+            public_url=str(server_cfg.get("publicUrl") or "").rstrip("/"),
+            trusted_proxies=[ipaddress.ip_network(str(p), strict=False)
+                             for p in server_cfg.get("trustedProxies", []) or []],
+            skills_dir=os.path.join(os.path.dirname(os.path.abspath(path)), server_cfg["skillsDir"])
+            if server_cfg.get("skillsDir") else os.path.join(BASE_DIR, "skills")
+        )
+        
+        web_cfg = data.get("web", {}) or {}
+        web_config = WebConfig(
+            poll_interval=parse_duration(web_cfg.get("pollInterval"), 30.0)
+        )
+        
+        http_cfg = data.get("httpClient", {}) or {}
+        http_client = HTTPClientConfig(
+            max_connections=int(http_cfg.get("maxConnections", 100)),
+            max_connections_per_host=int(http_cfg.get("maxConnectionsPerHost", 10)),
+            keep_alive=parse_duration(http_cfg.get("keepAlive"), 30.0)
+        )
+        
+        security_cfg = data.get("security", {}) or {}
+        security = SecurityConfig(
+            allowed_commands=security_cfg.get("allowedCommands", []) or []
+        )
+        
+        cors_cfg = data.get("cors", {}) or {}
+        cors = CorsConfig(
+            allowed_origins=cors_cfg.get("allowedOrigins", []) or [],
+            allowed_methods=[m.upper() for m in cors_cfg.get("allowedMethods", []) or ["GET", "POST"]],
+            allowed_headers=cors_cfg.get("allowedHeaders", []) or list(DEFAULT_CORS_HEADERS),
+            max_age=parse_duration(cors_cfg.get("maxAge"), 600.0)
+        )
+        
+        sampling_cfg = data.get("sampling", {}) or {}
+        sampling = SamplingConfig(
+            url=sampling_cfg["url"],
+            timeout=parse_duration(sampling_cfg.get("timeout"), 60.0)
+        ) if sampling_cfg.get("url") else None
+        
+        defaults = data.get("defaults", {}) or {}
+        config: Dict[str, MCPService] = {}
+        for svc in entries:
+            svc = apply_defaults(defaults, svc)
             if svc.get("enabled", True):
-                self.config[svc["name"]] = MCPService(
+                config[svc["name"]] = MCPService(
                     name=svc["name"],
                     display_name=svc.get("displayName", svc["name"]),
                     description=svc.get("description", ""),
@@ -74,14 +1103,241 @@ class MCPManager:
                     args=svc.get("args", []),
                     env=svc.get("env", []),
                     port=svc.get("port", 3001),
-                    enabled=True
+                    enabled=True,
+                    tools=self._load_tools(svc.get("tools", [])),
+                    ephemeral=svc.get("ephemeral", False),
+                    pool_size=int(svc.get("poolSize", 0)),
+                    health_check=self._load_health_check(svc.get("healthCheck")),
+                    roots=self._load_roots(svc.get("roots", [])),
+                    allow_tools=svc.get("allowTools", []) or [],
+                    deny_tools=svc.get("denyTools", []) or [],
+                    env_files=self._load_env_files(path, svc),
+                    inherit_env=bool(svc.get("inheritEnv", False)),
+                    framing=self._load_framing(svc),
+                    auto_restart_on_change=bool(svc.get("autoRestartOnChange", False)),
+                    max_lifetime=parse_duration(svc.get("maxLifetime"), 0.0),
+                    alias_of=svc.get("aliasOf", ""),
+                    timeout=parse_duration(svc.get("timeout"), 0.0),
+                    init_timeout=parse_duration(svc.get("initTimeout"), INIT_TIMEOUT),
+                    init_retries=max(int(svc.get("initRetries", INIT_RETRIES)), 0),
+                    overridable=self._load_overridable(svc.get("overridable")),
+                    headers=self._load_headers(svc.get("headers", {})),
+                    validate_results=self._load_validate_results(svc),
+                    forward_caller=bool(svc.get("forwardCaller", False)),
+                    reauth_tool=svc.get("reauthTool", ""),
+                    rate_limit=float(svc.get("rateLimit", 0)),
+                    max_concurrency=int(svc.get("maxConcurrency", 0)),
+                    queue_depth=int(svc.get("queueDepth", 100)),
+                    labels={str(k): str(v) for k, v in (svc.get("labels") or {}).items()},
+                    tags=[str(t) for t in svc.get("tags") or []],
+                    container=svc.get("container", ""),
+                    start_on_boot=bool(svc.get("startOnBoot", True)),
+                    lenient_json=bool(svc.get("lenientJson", False)),
+                    client_capabilities=self._load_client_capabilities(svc, sampling)
                 )
         
-        print(f"Loaded {len(self.config)} services")
+        for name, svc in config.items():
+            if not svc.alias_of:
+                continue
+            target = config.get(svc.alias_of)
+            if target is None:
+                raise ValueError(f"service {name}: aliasOf {svc.alias_of} is not an enabled service")
+            if target.alias_of:
+                raise ValueError(f"service {name}: aliasOf must reference a service that is not itself an alias")
+        
+        for name, svc in config.items():
+            if not svc.alias_of and not all(security.command_allowed(c) for c in (svc.executable, svc.command)):
+                raise ValueError(f"service {name}: command '{svc.command}' is not in security.allowedCommands")
+        
+        # 校验全部通过：替换当前配置
+        if self.config_path and server.base_path != self.server.base_path:
+            log(f"server.basePath change requires a restart, keeping {self.server.base_path or '/'}")
+            server.base_path = self.server.base_path
+        self.config_path = os.path.abspath(path)
+        self.configured_count = len(data.get("mcp", {}).get("enabled", []) or [])
+        self.server = server
+        n = server.max_concurrent_starts
+        self.start_slots = asyncio.Semaphore(n) if n > 0 else None
+        self.web = web_config
+        self.http_client = http_client
+        self.security = security
+        if not security.allowed_commands:
+            log("security.allowedCommands is not set: any configured command may be launched")
+        self.cors = cors
+        self.sampling = sampling
+        
+        old_roots = {name: svc.roots for name, svc in self.config.items()}
+        old_specs = {name: svc.launch_spec() for name, svc in self.config.items()}
+        self.config.clear()
+        self.config.update(config)
+        
+        # 上游配额按实际进程计算（别名共享所引用服务的配额）
+        self.limiters = {
+            name: ServiceLimiter(svc.rate_limit, svc.max_concurrency, svc.queue_depth)
+            for name, svc in self.config.items()
+            if not svc.alias_of and (svc.rate_limit > 0 or svc.max_concurrency > 0)
+        }
+        
+        log(f"Loaded {len(self.config)} services")
+        
+        # 重新加载时通知 roots 发生变化的运行中服务
+        for name, svc in self.config.items():
+            if name in old_roots and old_roots[name] != svc.roots:
+                for m in self._members(name):
+                    if m.process.poll() is None:
+                        asyncio.ensure_future(self._write(m, {
+                            "jsonrpc": "2.0",
+                            "method": "notifications/roots/list_changed"
+                        }))
+        
+        if not old_specs:
+            return
+        
+        # 热重载：只处理有变化的服务，其余服务保持运行
+        for name in old_specs.keys() - self.config.keys():
+            if self._members(name):
+                log(f"Reload: stopping {name} (removed from config)")
+                asyncio.ensure_future(self.stop_service(name))
+        for name in self.config.keys() - old_specs.keys():
+            if not self.config[name].alias_of:
+                log(f"Reload: starting {name} (added to config)")
+                asyncio.ensure_future(self.start_service(name))
+        
+        # 启动参数变化的运行中服务：自动重启或标记为配置漂移
+        self.drift &= set(self.config)
+        for name, svc in self.config.items():
+            if svc.alias_of or name not in old_specs:
+                continue
+            spec = svc.launch_spec()
+            changed = [k for k in spec if spec[k] != old_specs[name][k]]
+            if not changed:
+                continue
+            # 切换常驻/临时模式：已有进程（常驻进程或预热进程）不再受新模式管理，始终重启
+            if "ephemeral" in changed and (name in self.running or name in self.pools):
+                log(f"Reload: restarting {name} (ephemeral changed)")
+                asyncio.ensure_future(self.restart_service(name))
+                continue
+            if not any(m.process.poll() is None for m in self._members(name)):
+                continue
+            if svc.auto_restart_on_change:
+                log(f"Reload: restarting {name} ({', '.join(changed)} changed)")
+                asyncio.ensure_future(self.restart_service(name))
+            else:
+                log(f"Reload: {name} needs a restart to apply {', '.join(changed)}")
+                self.drift.add(name)
+    
+    def _load_api_keys(self, items: List[Any]) -> List[str]:
+        """加载 API Key：支持字符串或 {value}/{valueFrom: env:X}"""
+        return [v for v in (resolve_value(item) for item in items or []) if v]
+    
+    def _load_validate_results(self, svc: dict) -> str:
+        """结果校验级别：off / warn / strict（true 等同 warn）"""
+        value = svc.get("validateResults", VALIDATE_OFF)
+        if isinstance(value, bool):
+            value = VALIDATE_WARN if value else VALIDATE_OFF
+        if value not in VALIDATE_MODES:
+            raise ValueError(f"service {svc['name']}: validateResults must be one of {', '.join(VALIDATE_MODES)}")
+        return value
+    
+    def _load_client_capabilities(self, svc: dict, sampling: Optional[SamplingConfig]) -> Dict[str, Any]:
+        """initialize 中声明的客户端能力：值为对象（与自动声明的能力合并）或 false（不声明）；
+        只能声明网关实际实现的能力：sampling 需配置 sampling.url，roots 需配置该服务的 roots"""
+        items = svc.get("clientCapabilities") or {}
+        if not isinstance(items, dict):
+            raise ValueError(f"service {svc['name']}: clientCapabilities must be a mapping")
+        implemented = {
+            "sampling": sampling is not None,
+            "roots": bool(svc.get("roots")),
+            "experimental": True,
+        }
+        for key, value in items.items():
+            if key not in implemented:
+                raise ValueError(f"service {svc['name']}: clientCapabilities.{key} is not supported by the gateway "
+                                 f"(supported: {', '.join(implemented)})")
+            if value is False:
+                continue
+            if not isinstance(value, dict):
+                raise ValueError(f"service {svc['name']}: clientCapabilities.{key} must be an object or false")
+            if not implemented[key]:
+                requirement = "sampling.url" if key == "sampling" else "roots on the service"
+                raise ValueError(f"service {svc['name']}: clientCapabilities.{key} requires {requirement}")
+        return dict(items)
+    
+    def _load_headers(self, items: Dict[str, Any]) -> Dict[str, str]:
+        """加载发往服务 HTTP 端点的请求头：值为字符串或 {value}/{valueFrom: env:X}"""
+        headers = {name: resolve_value(item) for name, item in (items or {}).items()}
+        return {name: value for name, value in headers.items() if value}
+    
+    def _load_tools(self, items: List[dict]) -> Dict[str, ToolConfig]:
+        """加载工具级配置"""
+        tools = {}
+        for t in items or []:
+            defaults = t.get("defaults", {}) or {}
+            try:
+                render_template(defaults, None)
+            except ValueError as e:
+                raise ValueError(f"tool {t['name']}: {e}")
+            tools[t["name"]] = ToolConfig(
+                name=t["name"],
+                defaults=defaults,
+                read_only=bool(t.get("readOnly", False)),
+                timeout=parse_duration(t.get("timeout"), 0.0)
+            )
+        return tools
+    
+    def _load_framing(self, svc: dict) -> str:
+        """校验分帧方式"""
+        framing = svc.get("framing", FRAMING_NEWLINE)
+        if framing not in FRAMINGS:
+            raise ValueError(f"service {svc['name']}: framing must be one of {', '.join(FRAMINGS)}")
+        return framing
+    
+    def _load_env_files(self, config_path: str, svc: dict) -> List[str]:
+        """envFile/envFiles：相对路径以配置文件所在目录为基准"""
+        files = svc.get("envFiles") or []
+        if svc.get("envFile"):
+            files = [svc["envFile"]] + list(files)
+        base = os.path.dirname(os.path.abspath(config_path))
+        return [f if os.path.isabs(f) else os.path.join(base, f) for f in files]
+    
+    def _load_roots(self, items: List[Any]) -> List[dict]:
+        """加载 roots：支持 URI 字符串、本地路径或 {uri, name}"""
+        roots = []
+        for item in items or []:
+            root = dict(item) if isinstance(item, dict) else {"uri": str(item)}
+            if "://" not in root["uri"]:
+                root["uri"] = "file://" + os.path.abspath(root["uri"])
+            roots.append(root)
+        return roots
+    
+    def _load_overridable(self, item: Optional[dict]) -> Optional[OverrideConfig]:
+        """加载可覆盖的启动参数白名单"""
+        if not item:
+            return None
+        return OverrideConfig(
+            env=[str(k) for k in item.get("env", []) or []],
+            args=[str(k) for k in item.get("args", []) or []],
+            max_instances=max(int(item.get("maxInstances", 4)), 1)
+        )
+    
+    def _load_health_check(self, item: Optional[dict]) -> Optional[HealthCheckConfig]:
+        """加载健康检查配置"""
+        if not item or not item.get("url"):
+            return None
+        return HealthCheckConfig(
+            url=item["url"],
+            timeout=parse_duration(item.get("timeout"), 5.0),
+            unhealthy_threshold=int(item.get("unhealthyThreshold", 3))
+        )
     
     def _build_env(self, svc: MCPService) -> dict:
-        """构建环境变量"""
-        env = os.environ.copy()
+        """构建环境变量：网关环境（inheritEnv）或基础变量 < 服务的 envFile < 服务的 env"""
+        if svc.inherit_env:
+            env = os.environ.copy()
+        else:
+            env = {k: os.environ[k] for k in BASE_ENV_KEYS if k in os.environ}
+        for path in svc.env_files:
+            env.update(load_env_file(path))
         for e in svc.env:
             name = e.get("name", "")
             value = e.get("value", "")
@@ -93,6 +1349,10 @@ class MCPManager:
                 key = value_from[4:]
                 if key in os.environ:
                     env[name] = os.environ[key]
+            elif value_from and value_from.startswith("file:"):
+                # 挂载的密钥文件（如 Kubernetes Secret），轮换后可被重新读取
+                with open(value_from[5:]) as f:
+                    env[name] = f.read().strip()
         return env
     
     async def start_service(self, name: str) -> bool:
@@ -100,160 +1360,1415 @@ class MCPManager:
         if name not in self.config:
             return False
         
-        # 已运行
-        if name in self.running:
-            proc = self.running[name].process
-            if proc.poll() is None:
-                return True
-        
         svc = self.config[name]
         
-        try:
-            # 构建命令
-            cmd = [svc.command] + svc.args
-            env = self._build_env(svc)
-            
-            # 启动进程
-            proc = subprocess.Popen(
-                cmd,
-                stdin=subprocess.PIPE,
-                stdout=subprocess.PIPE,
-                stderr=subprocess.STDOUT,
-                env=env,
-                start_new_session=True
-            )
-            
-            self.running[name] = RunningMCP(
-                process=proc,
-                port=svc.port,
-                started_at=time.time()
-            )
-            
-            # 等待启动
-            await asyncio.sleep(5)
-            
-            # MCP 初始化
-            await self._send(name, {
-                "jsonrpc": "2.0",
-                "id": 1,
-                "method": "initialize",
-                "params": {
-                    "protocolVersion": "2024-11-05",
-                    "capabilities": {},
-                    "clientInfo": {"name": "gateway", "version": "1.0"}
-                }
-            })
-            
-            await asyncio.sleep(1)
+        # 别名：启动所引用服务的进程
+        if svc.alias_of:
+            return await self.start_service(svc.alias_of)
+        
+        # 临时模式：每次调用时才启动进程（poolSize 为预热的备用进程数）
+        if svc.ephemeral:
+            self._check_runtime(svc)
+            await self._refill(name)
+            return True
+        
+        # 启动中：等待同一次启动的结果
+        task = self.starting.get(name)
+        if task is None:
+            if self.get_status(name) == "running":
+                return True
+            task = asyncio.ensure_future(self._start_when_ready(name, svc))
+            self.starting[name] = task
+            task.add_done_callback(lambda t: self.starting.pop(name, None) if self.starting.get(name) is t else None)
             
-            # notifications/initialized
-            await self._send(name, {
-                "jsonrpc": "2.0",
-                "method": "notifications/initialized"
-            })
+            # 发起方的请求被取消（如客户端断开）时一并中止启动
+            try:
+                await asyncio.wait([task])
+            except asyncio.CancelledError:
+                task.cancel()
+                raise
+        else:
+            await asyncio.wait([task])
+        
+        if task.cancelled():
+            raise web.HTTPConflict(text=f"Start of {name} was cancelled")
+        return task.result()
+    
+    async def _start_when_ready(self, name: str, svc: MCPService) -> bool:
+        # 限制同时启动的进程数（首次启动时 uvx/npx 可能需要下载依赖）
+        async with self.start_slots or contextlib.nullcontext():
+            self.events.publish("starting", name)
+            return await self._start(name, svc)
+    
+    async def _start(self, name: str, svc: MCPService) -> bool:
+        members = []
+        try:
+            for _ in range(max(svc.pool_size, 1)):
+                members.append(await self._spawn(svc))
+            self.running[name] = members[0]
+            if len(members) > 1:
+                self.pools[name] = members
+            await asyncio.gather(*(self._initialize(m) for m in members))
             
-            print(f"Started {name} on port {svc.port}")
+            log(f"Started {name} on port {svc.port}" +
+                (f" (pool of {len(members)})" if len(members) > 1 else ""))
+            self.start_errors.pop(name, None)
+            self.events.publish("started", name)
             return True
             
+        except asyncio.CancelledError:
+            log(f"Cancelled start of {name}")
+            for m in members:
+                self._terminate(m.process)
+            self.running.pop(name, None)
+            self.pools.pop(name, None)
+            self.events.publish("stopped", name)
+            raise
+        except web.HTTPException as e:
+            self.start_errors[name] = error_message(e)
+            raise
         except Exception as e:
-            print(f"Failed to start {name}: {e}")
+            log(f"Failed to start {name}: {e or type(e).__name__}")
+            self.start_errors[name] = str(e) or type(e).__name__
+            for m in members:
+                self._terminate(m.process)
+            self.running.pop(name, None)
+            self.pools.pop(name, None)
             return False
     
-    async def _send(self, name: str, data: dict) -> None:
-        if name not in self.running:
+    def check_runtimes(self) -> Dict[str, bool]:
+        """检查常见运行时及已配置服务的命令是否在 PATH 中"""
+        commands = set(RUNTIME_HINTS) | {svc.executable for svc in self.config.values() if not svc.alias_of}
+        self.runtimes = {cmd: shutil.which(cmd) is not None for cmd in sorted(commands)}
+        
+        for name, svc in self.config.items():
+            if not svc.alias_of and not self.runtimes.get(svc.executable):
+                log(f"Warning: {name} requires '{svc.executable}' which is not on PATH")
+        return self.runtimes
+    
+    def diagnostics(self) -> dict:
+        """启动诊断信息：配置、运行时、Docker、监听地址与认证、配置告警"""
+        warnings = []
+        for name, svc in self.config.items():
+            if not svc.alias_of and not self.runtimes.get(svc.executable):
+                warnings.append(f"{name}: command '{svc.executable}' is not on PATH")
+            for path in svc.env_files:
+                if not os.path.exists(path):
+                    warnings.append(f"{name}: envFile {path} does not exist")
+            try:
+                expand_args(svc.args)
+            except ValueError as e:
+                warnings.append(f"{name}: args {e}")
+        if not is_loopback(self.server.host) and not self.server.api_keys:
+            warnings.append(f"binding to {self.server.host} without authentication")
+        
+        docker = {"available": bool(shutil.which("docker")), "version": None}
+        if docker["available"]:
+            try:
+                out = subprocess.run(["docker", "--version"], capture_output=True, timeout=3)
+                docker["version"] = out.stdout.decode(errors="replace").strip() or None
+            except (OSError, subprocess.TimeoutExpired):
+                pass
+        
+        return {
+            "configPath": self.config_path or None,
+            "services": {"configured": self.configured_count, "enabled": len(self.config)},
+            "runtimes": self.runtimes,
+            "docker": docker,
+            "bind": {"host": self.server.host, "port": PORT},
+            "auth": {"enabled": bool(self.server.api_keys), "readOnly": self.server.read_only},
+            "calls": {"inFlight": self.active_calls, "limit": self.server.max_concurrent_calls or None},
+            "warnings": warnings,
+        }
+    
+    def _check_runtime(self, svc: MCPService) -> None:
+        """运行时不可用时返回 503 和安装指引"""
+        if shutil.which(svc.executable) is None:
+            hint = RUNTIME_HINTS.get(os.path.basename(svc.executable),
+                                     f"install '{svc.executable}' or fix PATH")
+            raise error_response(
+                web.HTTPServiceUnavailable, "RUNTIME_UNAVAILABLE",
+                f"Runtime '{svc.executable}' for service {svc.name} is not available: {hint}",
+                runtime=svc.executable
+            )
+        
+        # exec 模式：目标容器须已存在并处于运行状态（生命周期由外部管理）
+        if svc.container:
+            try:
+                out = subprocess.run(["docker", "inspect", "-f", "{{.State.Running}}", svc.container],
+                                     capture_output=True, timeout=5)
+                running = out.returncode == 0 and out.stdout.strip() == b"true"
+            except (OSError, subprocess.TimeoutExpired):
+                running = False
+            if not running:
+                raise error_response(
+                    web.HTTPServiceUnavailable, "CONTAINER_NOT_RUNNING",
+                    f"Container '{svc.container}' for service {svc.name} does not exist or is not running",
+                    container=svc.container
+                )
+    
+    async def _spawn(self, svc: MCPService, extra_args: Optional[List[str]] = None) -> RunningMCP:
+        """启动 MCP 进程；extra_args 追加在展开后的 args 之后，不做引用展开（调用方提供的覆盖参数）"""
+        for command in (svc.executable, svc.command):
+            if not self.security.command_allowed(command):
+                raise error_response(
+                    web.HTTPForbidden, "COMMAND_NOT_ALLOWED",
+                    f"Command '{command}' for service {svc.name} is not in security.allowedCommands",
+                    command=command
+                )
+        self._check_runtime(svc)
+        
+        # 构建命令（args 中的引用在启动时展开，不写回配置）
+        try:
+            cmd = replace(svc, args=expand_args(svc.args) + list(extra_args or [])).argv()
+        except ValueError as e:
+            raise error_response(
+                web.HTTPServiceUnavailable, "ARG_UNRESOLVED",
+                f"Service {svc.name} args: {e}"
+            )
+        env = self._build_env(svc)
+        
+        # 启动进程
+        proc = subprocess.Popen(
+            cmd,
+            stdin=subprocess.PIPE,
+            stdout=subprocess.PIPE,
+            stderr=subprocess.PIPE,
+            env=env,
+            start_new_session=True
+        )
+        
+        running = RunningMCP(
+            process=proc,
+            port=svc.port,
+            started_at=time.time(),
+            name=svc.name,
+            framing=svc.framing,
+            env=env
+        )
+        
+        # 启动读取线程（每个进程一个，避免阻塞事件循环）
+        loop = asyncio.get_running_loop()
+        threading.Thread(
+            target=self._read_loop, args=(svc.name, running, loop), daemon=True
+        ).start()
+        threading.Thread(
+            target=self._read_stderr, args=(running,), daemon=True
+        ).start()
+        return running
+    
+    def _read_stderr(self, running: RunningMCP) -> None:
+        """收集 stderr 日志（保留最近若干行），同时避免管道写满阻塞子进程"""
+        for line in iter(running.process.stderr.readline, b""):
+            running.stderr.append((time.time(), line.decode(errors="replace").rstrip("\n")))
+    
+    def _read_loop(self, name: str, running: RunningMCP, loop) -> None:
+        """读取 MCP 输出（在独立线程中运行）"""
+        stdout = running.process.stdout
+        if running.framing == FRAMING_CONTENT_LENGTH:
+            messages = iter(lambda: read_framed(stdout), None)
+        else:
+            messages = iter(stdout.readline, b"")
+        for message in messages:
+            loop.call_soon_threadsafe(self._on_message, name, running, message, time.time())
+        # 输出结束后稍等进程退出，以便拿到退出码
+        try:
+            running.process.wait(timeout=5)
+        except subprocess.TimeoutExpired:
+            pass
+        loop.call_soon_threadsafe(self._on_exit, name, running)
+    
+    def _on_message(self, name: str, running: RunningMCP, line: bytes, arrived: float) -> None:
+        """分发一条 MCP 消息：响应 / 服务端请求 / 通知"""
+        svc = self.config.get(name)
+        try:
+            if svc and svc.lenient_json:
+                data = json.loads(line, parse_constant=reject_constant)
+            else:
+                data = json.loads(line)
+        except ValueError as e:
+            data = self._repair_message(name, running, line, e) if svc and svc.lenient_json else None
+            if data is None:
+                self._on_noise(name, running, line)
+                return
+        if not isinstance(data, dict):
+            self._on_noise(name, running, line)
+            return
+        
+        # 服务端发起的请求
+        if "method" in data and "id" in data:
+            asyncio.create_task(self._handle_server_request(name, running, data))
+            return
+        
+        # 响应
+        if "id" in data:
+            future = running.pending.pop(data["id"], None)
+            if future and not future.done():
+                running.arrivals[data["id"]] = arrived
+                if "error" in data:
+                    future.set_exception(MCPError(data["error"]))
+                else:
+                    future.set_result(data.get("result", {}))
             return
-        proc = self.running[name].process
-        proc.stdin.write((json.dumps(data) + "\n").encode())
-        proc.stdin.flush()
+        
+        # 通知
+        if "method" in data:
+            log(f"Notification from {name}: {data['method']}")
+            if data["method"] == "notifications/tools/list_changed" and running in self._members(name):
+                asyncio.create_task(self._on_tools_changed(name))
     
-    async def stop_service(self, name: str) -> bool:
-        """停止 MCP 服务"""
-        if name not in self.running:
-            return True
+    def _repair_message(self, name: str, running: RunningMCP, line: bytes, error: ValueError) -> Any:
+        """lenientJson：修复常见的不合规 JSON 后重新解析；无法修复时返回 None"""
+        try:
+            data = json.loads(repair_json(line.decode("utf-8")), parse_constant=reject_constant)
+        except ValueError:
+            return None
+        running.json_repairs += 1
+        if running.json_repairs <= STDOUT_NOISE_WARN_LIMIT:
+            log(f"Warning: {name} sent malformed JSON ({error}); accepted after repair (lenientJson)")
+            if running.json_repairs == STDOUT_NOISE_WARN_LIMIT:
+                log(f"Warning: further repaired messages from {name} will not be logged")
+        return data
+    
+    def _on_noise(self, name: str, running: RunningMCP, line: bytes) -> None:
+        """stdout 上的非 JSON-RPC 输出：跳过并告警（日志应写到 stderr）"""
+        text = line.decode(errors="replace").strip()
+        if not text:
+            return
+        running.stdout_noise += 1
+        if running.stdout_noise <= STDOUT_NOISE_WARN_LIMIT:
+            log(f"Warning: {name} wrote non-JSON output to stdout (should go to stderr), "
+                f"skipped: {text[:200]}")
+            if running.stdout_noise == STDOUT_NOISE_WARN_LIMIT:
+                log(f"Warning: further non-JSON stdout output from {name} will be skipped silently")
+    
+    def _on_exit(self, name: str, running: RunningMCP) -> None:
+        """进程输出结束：让所有等待中的请求失败"""
+        # 仍在管理中的进程退出（非主动停止）
+        if running in self._members(name):
+            self.events.publish("exited", name, code=running.process.poll())
+
+        for future in running.pending.values():
+            if not future.done():
+                future.set_exception(MCPError(f"{name} process exited"))
+        running.pending.clear()
+    
+    async def _request(self, running: RunningMCP, method: str, params: dict,
+                       timeout: float = REQUEST_TIMEOUT) -> Any:
+        """发送请求并等待对应 id 的响应"""
+        req_id = running.request_id
+        running.request_id += 1
         
-        proc = self.running[name].process
+        future = asyncio.get_running_loop().create_future()
+        running.pending[req_id] = future
+        timings = CALL_TIMINGS.get() if method == "tools/call" else None
+        try:
+            started = time.time()
+            await self._write(running, {
+                "jsonrpc": "2.0",
+                "id": req_id,
+                "method": method,
+                "params": params
+            })
+            written = time.time()
+            result = await asyncio.wait_for(future, timeout=timeout)
+            if timings is not None:
+                # server：写入完成 → 响应到达；read：响应到达 → 解析并交付给调用方
+                arrived = running.arrivals.get(req_id, written)
+                timings.update(write=written - started, server=arrived - written, read=time.time() - arrived)
+            return result
+        finally:
+            running.pending.pop(req_id, None)
+            running.arrivals.pop(req_id, None)
+    
+    async def _handle_server_request(self, name: str, running: RunningMCP, msg: dict) -> None:
+        """响应 MCP 服务端发起的请求，避免服务端一直等待"""
+        method = msg.get("method")
+        reply = {"jsonrpc": "2.0", "id": msg["id"]}
+        
+        try:
+            if method == "ping":
+                reply["result"] = {}
+            elif method == "roots/list" and name in self.config:
+                reply["result"] = {"roots": self.config[name].roots}
+            elif method == "sampling/createMessage":
+                reply["result"] = await self._sample(name, msg.get("params", {}))
+            else:
+                reply["error"] = {"code": -32601, "message": f"Method not found: {method}"}
+        except MCPError as e:
+            reply["error"] = e.error
+        except Exception as e:
+            reply["error"] = {"code": -32603, "message": f"{method} failed: {e}"}
+        
+        if running.process.poll() is None:
+            await self._write(running, reply)
+    
+    async def _sample(self, name: str, params: dict) -> dict:
+        """将 sampling/createMessage 转发到配置的 webhook"""
+        if not self.sampling:
+            raise MCPError({"code": -32601, "message": "Sampling is not supported: no sampler configured"})
+        
+        timeout = aiohttp.ClientTimeout(total=self.sampling.timeout)
+        async with self.http_session().post(self.sampling.url, json=params, timeout=timeout,
+                                            headers={"X-MCP-Service": name}) as resp:
+            if resp.status >= 400:
+                raise MCPError({"code": -32603, "message": f"Sampler returned HTTP {resp.status}"})
+            return await resp.json()
+    
+    def http_session(self) -> aiohttp.ClientSession:
+        """共享的 HTTP 会话：复用 keep-alive 连接，按 httpClient 配置限制连接数"""
+        if self.http is None or self.http.closed:
+            cfg = self.http_client
+            self.http = aiohttp.ClientSession(connector=aiohttp.TCPConnector(
+                limit=cfg.max_connections,
+                limit_per_host=cfg.max_connections_per_host,
+                keepalive_timeout=cfg.keep_alive
+            ))
+        return self.http
+    
+    async def close_http(self) -> None:
+        if self.http is not None:
+            await self.http.close()
+            self.http = None
+    
+    async def _initialize(self, running: RunningMCP) -> None:
+        """MCP 初始化握手（持有进程锁，握手完成前不接受调用）"""
+        async with running.lock:
+            await self._initialize_locked(running)
+    
+    async def _initialize_locked(self, running: RunningMCP) -> None:
+        capabilities = {}
+        if self.sampling:
+            capabilities["sampling"] = {}
+        svc = self.config.get(running.name)
+        if svc and svc.roots:
+            capabilities["roots"] = {"listChanged": True}
+        # clientCapabilities：合并到自动声明的能力之上，false 表示不声明
+        for key, value in (svc.client_capabilities if svc else {}).items():
+            if value is False:
+                capabilities.pop(key, None)
+            else:
+                capabilities[key] = {**capabilities.get(key, {}), **value}
+        
+        # MCP 初始化：超时且进程仍存活时重试（进程退出或返回错误则直接失败）
+        timeout = svc.init_timeout if svc else INIT_TIMEOUT
+        attempts = 1 + (svc.init_retries if svc else INIT_RETRIES)
+        started = time.time()
+        for attempt in range(1, attempts + 1):
+            try:
+                result = await self._request(running, "initialize", {
+                    "protocolVersion": "2024-11-05",
+                    "capabilities": capabilities,
+                    "clientInfo": {"name": "gateway", "version": "1.0"}
+                }, timeout=timeout)
+                break
+            except asyncio.TimeoutError:
+                elapsed = time.time() - started
+                if attempt == attempts or running.process.poll() is not None:
+                    log(f"{running.name}: initialize failed after {attempt} attempt(s), {elapsed:.1f}s")
+                    raise
+                log(f"{running.name}: initialize attempt {attempt}/{attempts} timed out ({elapsed:.1f}s elapsed), retrying")
+        if attempt > 1:
+            log(f"{running.name}: initialized on attempt {attempt} ({time.time() - started:.1f}s)")
+        running.initialize_result = result or {}
+        running.capabilities = (result or {}).get("capabilities") or {}
+        
+        # notifications/initialized
+        await self._write(running, {
+            "jsonrpc": "2.0",
+            "method": "notifications/initialized"
+        })
+        running.ready.set()
+    
+    def _terminate(self, proc: subprocess.Popen) -> None:
+        """终止进程（超时则强杀）"""
         proc.terminate()
         try:
             proc.wait(timeout=5)
         except:
             proc.kill()
+    
+    async def _write(self, running: RunningMCP, data: dict) -> None:
+        """写入一条完整消息：持有进程写锁避免并发写入交错，在线程中写入以免管道写满时阻塞事件循环"""
+        frame = encode_frame(data, running.framing)
+        async with running.write_lock:
+            await asyncio.to_thread(self._write_frame, running.process.stdin, frame)
+    
+    @staticmethod
+    def _write_frame(stdin, frame: bytes) -> None:
+        # BufferedWriter.write 在阻塞管道上会循环直到写完或出错
+        stdin.write(frame)
+        stdin.flush()
+    
+    def _runtime(self, name: str) -> str:
+        """实际承载进程的服务名（别名解析为所引用的服务）"""
+        svc = self.config.get(name)
+        return svc.alias_of if svc and svc.alias_of else name
+    
+    def _members(self, name: str) -> List[RunningMCP]:
+        """服务的全部进程（进程池或单进程）"""
+        name = self._runtime(name)
+        if name in self.pools:
+            return self.pools[name]
+        return [self.running[name]] if name in self.running else []
+    
+    def _pick(self, name: str) -> RunningMCP:
+        """选择最空闲的存活进程，并替换已退出的池成员"""
+        name = self._runtime(name)
+        members = self._members(name)
+        alive = [m for m in members if m.process.poll() is None]
+        
+        if name in self.pools:
+            for m in members:
+                if m.process.poll() is not None:
+                    asyncio.create_task(self._replace(name, m))
+        
+        if not alive:
+            raise service_not_running(name, web.HTTPBadRequest)
+        return min(alive, key=lambda m: m.busy)
+    
+    async def _replace(self, name: str, old: RunningMCP) -> None:
+        """用新进程替换已退出的池成员"""
+        pool = self.pools.get(name)
+        if not pool or old not in pool:
+            return
+        
+        try:
+            new = await self._spawn(self.config[name])
+        except Exception as e:
+            log(f"Failed to replace pool member of {name}: {e}")
+            return
+        
+        # 期间服务可能已被停止或成员已被替换
+        pool = self.pools.get(name)
+        if not pool or old not in pool:
+            self._terminate(new.process)
+            return
+        
+        pool[pool.index(old)] = new
+        if self.running.get(name) is old:
+            self.running[name] = new
+        try:
+            await self._initialize(new)
+        except Exception as e:
+            log(f"Failed to initialize replacement for {name}: {e or type(e).__name__}")
+            self._terminate(new.process)
+            return
+        log(f"Replaced dead pool member of {name}")
+        self.events.publish("restarted", name)
+    
+    async def _refill(self, name: str) -> None:
+        """补充临时模式的预热进程（同一服务的并发补充共享同一个任务）"""
+        task = self.refills.get(name)
+        if task is None:
+            task = asyncio.ensure_future(self._fill_spares(name))
+            self.refills[name] = task
+            task.add_done_callback(lambda t: self.refills.pop(name, None) if self.refills.get(name) is t else None)
+        try:
+            await asyncio.shield(task)
+        except asyncio.CancelledError:
+            # 补充任务被 stop_service 取消时不影响等待方
+            if not task.cancelled():
+                raise
+    
+    async def _fill_spares(self, name: str) -> None:
+        svc = self.config[name]
+        spares = self.pools.setdefault(name, [])
+        spares[:] = [m for m in spares if m.process.poll() is None]
+        
+        while len(spares) < svc.pool_size:
+            try:
+                running = await self._spawn(svc)
+            except Exception as e:
+                log(f"Failed to prepare warm process for {name}: {e}")
+                return
+            # 完成初始化后才放入备用列表，调用方不会取到仍在握手的进程
+            try:
+                await self._initialize(running)
+            except asyncio.CancelledError:
+                self._terminate(running.process)
+                raise
+            except Exception as e:
+                log(f"Failed to initialize warm process for {name}: {e or type(e).__name__}")
+                self._terminate(running.process)
+                return
+            # 期间服务可能已被停止
+            if self.pools.get(name) is not spares:
+                self._terminate(running.process)
+                return
+            spares.append(running)
+    
+    async def recycle_loop(self) -> None:
+        """按 maxLifetime 定期回收常驻进程，并处理密钥轮换：每个服务每轮只回收一个成员"""
+        while True:
+            await asyncio.sleep(10)
+            now = time.time()
+            for name, svc in list(self.config.items()):
+                if svc.ephemeral or svc.alias_of:
+                    continue
+                # 单个服务出错不能终止循环，否则所有服务的密钥轮换与 maxLifetime 回收都会停止
+                try:
+                    await self._recycle_service(name, svc, now)
+                except Exception as e:
+                    log(f"Recycle check failed for {name}: {e or type(e).__name__}")
+    
+    async def _recycle_service(self, name: str, svc: MCPService, now: float) -> None:
+        if await self._rotate_secrets(name, svc):
+            return
+        if not svc.max_lifetime:
+            return
+        expired = [m for m in self._members(name)
+                   if m.process.poll() is None and now - m.started_at >= svc.max_lifetime]
+        if expired:
+            await self._recycle(name, min(expired, key=lambda m: m.started_at))
+    
+    async def _rotate_secrets(self, name: str, svc: MCPService) -> bool:
+        """重新读取配置了 onChange 的环境变量；变化时调用 reauthTool 下发新值，
+        不支持或失败时平滑回收进程。返回是否回收了进程"""
+        watched = {e["name"]: e["onChange"] for e in svc.env if e.get("name") and e.get("onChange")}
+        if not watched:
+            return False
+        try:
+            env = self._build_env(svc)
+        except (OSError, ValueError) as e:
+            log(f"Failed to re-read secrets for {name}: {e}")
+            return False
+        
+        for m in self._members(name):
+            if m.process.poll() is not None:
+                continue
+            changed = [k for k in watched if env.get(k) != m.env.get(k)]
+            if not changed:
+                continue
+            
+            if svc.reauth_tool and all(watched[k] == "reauth" for k in changed):
+                try:
+                    for k in changed:
+                        result = await self._call(m, svc.reauth_tool, {"name": k, "value": env.get(k, "")},
+                                                  self.tool_timeout(name, svc.reauth_tool))
+                        if isinstance(result, dict) and result.get("isError"):
+                            raise web.HTTPBadGateway(text=f"{svc.reauth_tool} returned an error")
+                        m.env[k] = env.get(k, "")
+                    log(f"Applied rotated {', '.join(changed)} to {name} via {svc.reauth_tool}")
+                    continue
+                except web.HTTPException as e:
+                    log(f"Re-auth of {name} via {svc.reauth_tool} failed, recycling: {error_message(e)}")
+            else:
+                log(f"{', '.join(changed)} changed for {name}, recycling")
+            await self._recycle(name, m)
+            return True
+        return False
+    
+    async def _recycle(self, name: str, old: RunningMCP) -> None:
+        """先启动并初始化新进程再替换，旧进程处理完进行中的调用后退出"""
+        try:
+            new = await self._spawn(self.config[name])
+        except Exception as e:
+            log(f"Failed to recycle {name}: {e}")
+            return
+        try:
+            await self._initialize(new)
+        except Exception as e:
+            log(f"Failed to initialize recycled process for {name}: {e or type(e).__name__}")
+            self._terminate(new.process)
+            return
+        
+        # 期间服务可能已被停止或成员已被替换
+        pool = self.pools.get(name)
+        if pool is not None and old in pool:
+            pool[pool.index(old)] = new
+        if self.running.get(name) is old:
+            self.running[name] = new
+        elif pool is None or new not in pool:
+            self._terminate(new.process)
+            return
+        
+        deadline = time.time() + self.server.shutdown_timeout
+        while old.busy and time.time() < deadline:
+            await asyncio.sleep(0.1)
+        self._terminate(old.process)
+        log(f"Recycled {name} (pid {old.process.pid} -> {new.process.pid}) after {time.time() - old.started_at:.0f}s")
+        self.events.publish("restarted", name)
+    
+    def get_logs(self, name: str) -> List[dict]:
+        """服务各进程缓冲的 stderr，按时间排序"""
+        entries = []
+        for m in self._members(name):
+            entries.extend({"time": t, "pid": m.process.pid, "line": line} for t, line in list(m.stderr))
+        return sorted(entries, key=lambda e: e["time"])
+    
+    def initialize_results(self, name: str) -> List[dict]:
+        """服务各进程 initialize 响应的原始 result"""
+        return [{"pid": m.process.pid, "result": m.initialize_result} for m in self._members(name)]
+    
+    def limit_stats(self, name: str) -> Optional[dict]:
+        """上游配额使用情况（未配置时为 None）"""
+        limiter = self.limiters.get(self._runtime(name))
+        return limiter.stats() if limiter else None
+    
+    def pool_stats(self, name: str) -> dict:
+        """进程池使用情况"""
+        members = self._members(name)
+        return {
+            "size": len(members),
+            "alive": sum(1 for m in members if m.process.poll() is None),
+            "busy": sum(m.busy for m in members),
+            "ready": sum(1 for m in members if m.ready.is_set()),
+        }
+    
+    def validate_overrides(self, name: str, overrides: Any) -> Optional[dict]:
+        """校验调用方的启动参数覆盖（只允许 overridable 中声明的键），返回规范化结果"""
+        if not overrides:
+            return None
+        svc = self.config[self._runtime(name)]
+        allowed = svc.overridable
+        if allowed is None:
+            raise web.HTTPBadRequest(text=f"Service {name} does not accept overrides")
+        if svc.ephemeral:
+            raise web.HTTPBadRequest(text=f"Service {name} is ephemeral: overrides are not supported")
+        if not isinstance(overrides, dict) or set(overrides) - {"args", "env"}:
+            raise web.HTTPBadRequest(text="overrides must be an object with args and/or env")
+        
+        result = {}
+        for kind, keys in (("args", allowed.args), ("env", allowed.env)):
+            values = overrides.get(kind) or {}
+            if not isinstance(values, dict):
+                raise web.HTTPBadRequest(text=f"overrides.{kind} must be an object")
+            for key, value in values.items():
+                if key not in keys:
+                    raise web.HTTPBadRequest(text=f"overrides.{kind}: {key} is not overridable")
+                if not isinstance(value, str) or not OVERRIDE_VALUE_RE.match(value):
+                    raise web.HTTPBadRequest(text=f"overrides.{kind}.{key}: invalid value")
+            if values:
+                result[kind] = dict(sorted(values.items()))
+        return result or None
+    
+    async def instance(self, name: str, overrides: dict) -> RunningMCP:
+        """获取（必要时启动）与覆盖参数对应的参数化实例；超出 maxInstances 时回收最久未用的空闲实例。
+        槽位在同步代码中预留（无需加锁），启动与初始化在独立任务中进行，慢启动不阻塞其他实例"""
+        runtime = self._runtime(name)
+        svc = self.config[runtime]
+        key = json.dumps(overrides, sort_keys=True)
+        
+        instances = self.instances.setdefault(runtime, {})
+        running = instances.pop(key, None)
+        if running and running.process.poll() is None:
+            instances[key] = running
+            return running
+        
+        task = self.instance_starts.get((runtime, key))
+        evicted = []
+        if task is None:
+            # 启动中的实例同样占用槽位
+            starting = sum(1 for r, _ in self.instance_starts if r == runtime)
+            while len(instances) + starting >= svc.overridable.max_instances:
+                idle = next((k for k, m in instances.items() if not m.busy), None)
+                if idle is None:
+                    raise web.HTTPServiceUnavailable(
+                        text=f"Service {name}: all {svc.overridable.max_instances} parameterized instances are busy")
+                evicted.append(instances.pop(idle).process)
+            task = asyncio.ensure_future(self._start_instance(runtime, svc, key, overrides))
+            self.instance_starts[(runtime, key)] = task
+            task.add_done_callback(lambda t: self._instance_started(runtime, key, t))
+        
+        for proc in evicted:
+            await asyncio.to_thread(self._terminate, proc)
+        # shield：单个调用方取消时不中止其他调用方共享的启动
+        try:
+            return await asyncio.shield(task)
+        except asyncio.CancelledError:
+            if task.cancelled():
+                raise web.HTTPConflict(text=f"Start of {name} parameterized instance was cancelled")
+            raise
+    
+    async def _start_instance(self, runtime: str, svc: MCPService, key: str, overrides: dict) -> RunningMCP:
+        # 覆盖参数原样追加：不展开 ${env:...}/${file:...}，避免调用方读取网关的环境变量或文件
+        args = []
+        for flag, value in overrides.get("args", {}).items():
+            args += [flag, value]
+        env = list(svc.env) + [{"name": k, "value": v} for k, v in overrides.get("env", {}).items()]
+        running = await self._spawn(replace(svc, env=env), args)
+        try:
+            await self._initialize(running)
+        except BaseException:
+            self._terminate(running.process)
+            raise
+        instances = self.instances.setdefault(runtime, {})
+        instances[key] = running
+        log(f"Started {runtime} parameterized instance {len(instances)}/{svc.overridable.max_instances} "
+            f"(pid {running.process.pid})")
+        return running
+    
+    def _instance_started(self, runtime: str, key: str, task: asyncio.Task) -> None:
+        if self.instance_starts.get((runtime, key)) is task:
+            del self.instance_starts[(runtime, key)]
+        # 取走异常，避免所有调用方都已取消时出现未读取异常的告警
+        if not task.cancelled():
+            task.exception()
+    
+    def _stop_instances(self, name: str) -> None:
+        for (runtime, _), task in list(self.instance_starts.items()):
+            if runtime == name:
+                task.cancel()
+        for running in self.instances.pop(name, {}).values():
+            self._terminate(running.process)
+    
+    async def stop_service(self, name: str) -> bool:
+        """停止 MCP 服务（别名停止所引用服务的进程）"""
+        name = self._runtime(name)
+        # 启动中：取消启动并结束已启动的进程
+        task = self.starting.get(name)
+        if task is not None:
+            task.cancel()
+            await asyncio.wait([task])
+        task = self.refills.get(name)
+        if task is not None:
+            task.cancel()
+        self._stop_instances(name)
+        members = self._members(name)
+        if not members:
+            return True
         
-        del self.running[name]
-        print(f"Stopped {name}")
+        for m in members:
+            self._terminate(m.process)
+        
+        self.running.pop(name, None)
+        self.pools.pop(name, None)
+        self.drift.discard(name)
+        self.start_errors.pop(name, None)
+        log(f"Stopped {name}")
+        self.events.publish("stopped", name)
         return True
     
+    async def restart_service(self, name: str) -> bool:
+        """重启 MCP 服务（使用当前配置）"""
+        await self.stop_service(name)
+        return await self.start_service(name)
+    
     async def stop_all(self, app=None) -> None:
-        """停止所有服务"""
-        for name in list(self.running.keys()):
-            await self.stop_service(name)
+        """停止所有服务：统一发送 SIGTERM，超过 shutdownTimeout 后 SIGKILL 剩余进程"""
+        members = []
+        for name in list(set(self.running) | set(self.pools)):
+            members.extend((name, m) for m in self._members(name))
+            self.running.pop(name, None)
+            self.pools.pop(name, None)
+        for task in list(self.instance_starts.values()):
+            task.cancel()
+        for name in list(self.instances):
+            members.extend((name, m) for m in self.instances.pop(name).values())
+        
+        for _, m in members:
+            if m.process.poll() is None:
+                m.process.terminate()
+        
+        deadline = time.time() + self.server.shutdown_timeout
+        while time.time() < deadline and any(m.process.poll() is None for _, m in members):
+            await asyncio.sleep(0.1)
+        
+        for name, m in members:
+            if m.process.poll() is None:
+                log(f"Force killing {name} (pid {m.process.pid}) after {self.server.shutdown_timeout:g}s")
+                m.process.kill()
+                m.process.wait()
+        
+        log(f"Stopped {len(members)} processes")
     
     def get_status(self, name: str) -> str:
         """获取状态"""
         if name not in self.config:
             return "unknown"
-        if name not in self.running:
-            return "stopped"
-        return "running" if self.running[name].process.poll() is None else "stopped"
+        if self.config[self._runtime(name)].ephemeral:
+            return "ephemeral"
+        if self._runtime(name) in self.starting:
+            return "starting"
+        alive = any(m.process.poll() is None for m in self._members(name))
+        return "running" if alive else "stopped"
     
-    async def list_tools(self, name: str) -> List[dict]:
-        """获取工具列表"""
-        if name not in self.running:
+    def tool_allowed(self, name: str, tool: str) -> bool:
+        """按 allowTools/denyTools（glob）判断工具是否可用"""
+        svc = self.config[name]
+        if svc.allow_tools and not any(fnmatch.fnmatchcase(tool, p) for p in svc.allow_tools):
+            return False
+        return not any(fnmatch.fnmatchcase(tool, p) for p in svc.deny_tools)
+    
+    async def list_tools(self, name: str, running: Optional[RunningMCP] = None) -> List[dict]:
+        """获取工具列表（已按 allowTools/denyTools 过滤）；同一服务的并发请求合并为一次上游调用。
+        running 为已初始化的进程（临时进程或参数化实例）时从该进程拉取"""
+        fetch = self.tool_fetches.get(name)
+        if fetch is None:
+            fetch = asyncio.ensure_future(self._fetch_tools(name, running))
+            self.tool_fetches[name] = fetch
+            fetch.add_done_callback(lambda _: self.tool_fetches.pop(name, None))
+        # shield：单个调用方取消时不影响共享同一结果的其他调用方
+        return await asyncio.shield(fetch)
+    
+    async def _fetch_tools(self, name: str, running: Optional[RunningMCP] = None) -> List[dict]:
+        tools = await self._list(name, "tools/list", "tools", running)
+        if tools is None:
             return []
+        self.tools[name] = [t for t in tools if self.tool_allowed(name, t.get("name", ""))]
+        return self.tools[name]
+    
+    async def _on_tools_changed(self, name: str) -> None:
+        """工具列表变化：丢弃该服务及其别名的缓存，重新拉取并发布 tools_changed 事件"""
+        before = {t.get("name") for t in self.tools.pop(name, [])}
+        for alias, svc in self.config.items():
+            if svc.alias_of == name:
+                self.tools.pop(alias, None)
+        try:
+            await asyncio.wait_for(asyncio.shield(self._fetch_tools(name)), TOOLS_FETCH_TIMEOUT)
+        except (asyncio.TimeoutError, web.HTTPException):
+            pass
+        if name not in self.tools:
+            log(f"Tools changed on {name} but the new list could not be fetched; cache cleared")
+            return
+        after = [t.get("name") for t in self.tools[name]]
+        added, removed = sorted(set(after) - before), sorted(before - set(after))
+        log(f"Tools changed on {name}: {len(after)} tools, +{len(added)} -{len(removed)}")
+        self.events.publish("tools_changed", name, tools=after, added=added, removed=removed)
+    
+    async def list_resources(self, name: str) -> List[dict]:
+        """获取资源列表"""
+        return await self._list(name, "resources/list", "resources") or []
+    
+    async def list_prompts(self, name: str) -> List[dict]:
+        """获取提示词列表"""
+        return await self._list(name, "prompts/list", "prompts") or []
+    
+    async def _list(self, name: str, method: str, key: str,
+                    running: Optional[RunningMCP] = None) -> Optional[List[dict]]:
+        """执行列表类请求；失败时返回 None"""
+        if running is not None:
+            async with running.lock:
+                return await self._paginate(name, running, method, key)
         
-        running = self.running[name]
+        runtime = self._runtime(name)
+        if runtime in self.config and self.config[runtime].ephemeral:
+            running = await self._spawn(self.config[runtime])
+            try:
+                await self._initialize(running)
+                return await self._paginate(name, running, method, key)
+            finally:
+                self._terminate(running.process)
         
-        await self._send(name, {
-            "jsonrpc": "2.0",
-            "id": running.request_id,
-            "method": "tools/list",
-            "params": {}
-        })
-        running.request_id += 1
+        if self.get_status(name) != "running":
+            return None
         
-        await asyncio.sleep(2)
+        running = self._pick(name)
+        async with running.lock:
+            return await self._paginate(name, running, method, key)
+    
+    async def _paginate(self, name: str, running: RunningMCP, method: str, key: str) -> Optional[List[dict]]:
+        """跟随 nextCursor 拉取全部分页并合并"""
+        items, cursor, seen = [], None, set()
+        while True:
+            params = {"cursor": cursor} if cursor else {}
+            try:
+                result = await self._request(running, method, params)
+            except (MCPError, asyncio.TimeoutError) as e:
+                log(f"{method} failed for {name}: {e or 'timeout'}")
+                return None
+            
+            items.extend(result.get(key, []))
+            cursor = result.get("nextCursor")
+            # 防止服务端返回重复游标导致死循环
+            if not cursor or cursor in seen:
+                return items
+            seen.add(cursor)
+    
+    async def ping(self, name: str) -> dict:
+        """发送 MCP ping 测量往返延迟；服务端不支持 ping 时退回 tools/list"""
+        if self.get_status(name) != "running":
+            raise service_not_running(name)
         
+        running = self._pick(name)
+        started = time.time()
+        method = "ping"
         try:
-            line = running.process.stdout.readline()
-            if line:
-                resp = json.loads(line)
-                return resp.get("result", {}).get("tools", [])
-        except:
-            pass
+            try:
+                await self._request(running, "ping", {}, timeout=PING_TIMEOUT)
+            except MCPError as e:
+                if e.code != -32601:
+                    raise
+                method = "tools/list"
+                started = time.time()
+                await self._request(running, "tools/list", {}, timeout=PING_TIMEOUT)
+        except asyncio.TimeoutError:
+            raise web.HTTPGatewayTimeout(text=f"{name} did not answer {method} within {PING_TIMEOUT}s")
+        except MCPError as e:
+            raise e.response(web.HTTPBadGateway, f"{name} {method} failed: {e.message}")
         
-        return []
+        return {"method": method, "latencyMs": round((time.time() - started) * 1000, 1)}
     
-    async def call_tool(self, name: str, tool: str, arguments: dict) -> dict:
-        """调用工具"""
-        if name not in self.running:
-            raise web.HTTPBadRequest(text=f"Service {name} not running")
+    async def read_resource(self, name: str, uri: str) -> dict:
+        """读取资源（resources/read）"""
+        if self.get_status(name) != "running":
+            raise service_not_running(name)
         
-        running = self.running[name]
+        running = self._pick(name)
+        try:
+            async with running.lock:
+                return await self._request(running, "resources/read", {"uri": uri})
+        except asyncio.TimeoutError:
+            raise web.HTTPGatewayTimeout(text=f"No response from MCP within {REQUEST_TIMEOUT}s")
+        except MCPError as e:
+            raise e.response(web.HTTPBadGateway, f"{name} resources/read failed: {e.message}")
+    
+    async def complete(self, name: str, ref: dict, argument: dict) -> dict:
+        """参数自动补全（completion/complete）；服务端不支持时返回空结果"""
+        if self.get_status(name) != "running":
+            raise service_not_running(name)
         
-        await self._send(name, {
-            "jsonrpc": "2.0",
-            "id": running.request_id,
-            "method": "tools/call",
-            "params": {"name": tool, "arguments": arguments}
-        })
-        running.request_id += 1
+        empty = {"completion": {"values": [], "hasMore": False}}
+        running = self._pick(name)
+        if "completions" not in running.capabilities:
+            return empty
+        
+        try:
+            async with running.lock:
+                return await self._request(running, "completion/complete",
+                                           {"ref": ref, "argument": argument})
+        except asyncio.TimeoutError:
+            raise web.HTTPGatewayTimeout(text=f"No response from MCP within {REQUEST_TIMEOUT}s")
+        except MCPError as e:
+            if e.code == -32601:
+                return empty
+            raise e.response(web.HTTPBadGateway, f"{name} completion/complete failed: {e.message}")
+    
+    async def get_tool(self, name: str, tool: str) -> Optional[dict]:
+        """获取单个工具定义（优先使用缓存的工具列表）"""
+        tools = self.tools.get(name)
+        if tools is None:
+            tools = await self.list_tools(name)
+        for t in tools:
+            if t.get("name") == tool:
+                return t
+        return None
+    
+    def tool_timeout(self, name: str, tool: str, ctx: Optional[CallContext] = None) -> float:
+        """调用超时：请求头 X-MCP-Timeout > 工具级 timeout > 服务级 timeout > 全局默认"""
+        if ctx and ctx.timeout:
+            return ctx.timeout
+        svc = self.config[name]
+        tool_cfg = svc.tools.get(tool)
+        return (tool_cfg and tool_cfg.timeout) or svc.timeout or REQUEST_TIMEOUT
+    
+    def prepare_arguments(self, name: str, tool: str, arguments: dict,
+                          ctx: Optional[CallContext] = None) -> dict:
+        """渲染并合并工具默认参数，并按工具 schema 校验"""
+        if not self.tool_allowed(name, tool):
+            raise web.HTTPForbidden(text=f"Tool {tool} is not allowed on {name}")
+        
+        tool_cfg = self.config[name].tools.get(tool)
+        if tool_cfg and tool_cfg.defaults:
+            ctx = ctx or CallContext()
+            now = time.time()
+            defaults = render_template(tool_cfg.defaults, {
+                "now": time.strftime("%Y-%m-%dT%H:%M:%S%z", time.localtime(now)),
+                "date": time.strftime("%Y-%m-%d", time.localtime(now)),
+                "service": name,
+                "tool": tool,
+                "caller": self.caller_identity(ctx.api_key),
+            })
+            arguments = merge_arguments(defaults, arguments)
+        
+        for t in self.tools.get(name, []):
+            if t.get("name") == tool:
+                errors = validate_arguments(t.get("inputSchema", {}), arguments)
+                if errors:
+                    raise web.HTTPBadRequest(text="Invalid arguments: " + "; ".join(errors))
+                break
+        
+        return arguments
+    
+    async def call_tool(self, name: str, tool: str, arguments: dict,
+                        ctx: Optional[CallContext] = None) -> dict:
+        """调用工具（记录调用历史）"""
+        # 全局调用并发上限：超出时直接拒绝，叠加在服务级配额之上
+        limit = self.server.max_concurrent_calls
+        if limit and self.active_calls >= limit:
+            raise error_response(web.HTTPServiceUnavailable, "GATEWAY_BUSY",
+                                 f"Too many tool calls in flight (limit {limit})",
+                                 headers={"Retry-After": "1"})
+        self.active_calls += 1
+        try:
+            return await self._call_tool_recorded(name, tool, arguments, ctx)
+        finally:
+            self.active_calls -= 1
+    
+    async def _call_tool_recorded(self, name: str, tool: str, arguments: dict,
+                                  ctx: Optional[CallContext]) -> dict:
+        started = time.time()
+        status, error = "ok", None
+        limiter = self.limiters.get(self._runtime(name))
+        timings = {}
+        token = CALL_TIMINGS.set(timings)
+        try:
+            if limiter:
+                await limiter.acquire(name)
+            timings["queue"] = time.time() - started
+            try:
+                result = await self._call_tool(name, tool, arguments, ctx)
+            finally:
+                if limiter:
+                    limiter.release()
+            self.check_result(name, tool, result)
+            return result
+        except web.HTTPException as e:
+            status, error = "error", error_message(e)
+            raise
+        except Exception as e:
+            status, error = "error", str(e)
+            raise
+        finally:
+            self.call_counts[name] = self.call_counts.get(name, 0) + 1
+            self.last_call_at[name] = started
+            timings["total"] = time.time() - started
+            for phase, seconds in timings.items():
+                self.latency.observe(name, phase, seconds)
+            CALL_TIMINGS.reset(token)
+            self.events.publish(
+                "tool_called" if status == "ok" else "tool_failed", name,
+                tool=tool, error=error, latencyMs=round(timings["total"] * 1000, 1),
+                requestId=REQUEST_ID.get() or None
+            )
+            self._record(name, {
+                "tool": tool,
+                "arguments": redact(arguments, self.server.redact_keys),
+                "status": status,
+                "error": error,
+                "latencyMs": round((time.time() - started) * 1000, 1),
+                "timestamp": started,
+                "requestId": REQUEST_ID.get() or None,
+            })
+    
+    def retain_result(self, name: str, result: Any) -> Optional[str]:
+        """短暂保留含二进制内容块的结果，返回可用于下载的 requestId"""
+        now = time.time()
+        for key in [k for k, (expires, _, _) in self.results.items() if expires <= now]:
+            del self.results[key]
+        
+        content = result.get("content") if isinstance(result, dict) else None
+        if not any(content_blob(block) for block in content or []):
+            return None
+        request_id = uuid.uuid4().hex
+        self.results[request_id] = (now + RESULT_TTL, name, result)
+        return request_id
+    
+    def get_result(self, name: str, request_id: str) -> Optional[dict]:
+        """读取保留的调用结果（过期或服务不匹配时为 None）"""
+        entry = self.results.get(request_id)
+        if not entry or entry[0] <= time.time() or entry[1] != name:
+            return None
+        return entry[2]
+    
+    def check_result(self, name: str, tool: str, result: Any) -> None:
+        """按工具声明的 outputSchema 校验 structuredContent（validateResults 为 warn 时告警，strict 时报错）"""
+        mode = self.config[name].validate_results
+        if mode == VALIDATE_OFF or not isinstance(result, dict) or result.get("isError"):
+            return
+        schema = next((t.get("outputSchema") for t in self.tools.get(name, [])
+                       if t.get("name") == tool), None)
+        if not schema:
+            return
+        
+        if "structuredContent" not in result:
+            errors = ["structuredContent: is required by outputSchema"]
+        else:
+            errors = validate_arguments(schema, result["structuredContent"], "structuredContent")
+        if not errors:
+            return
+        
+        message = f"{name}/{tool} result does not match outputSchema: " + "; ".join(errors)
+        if mode == VALIDATE_STRICT:
+            raise web.HTTPBadGateway(text=message)
+        log(f"Warning: {message}")
+    
+    def _record(self, name: str, entry: dict) -> None:
+        """写入有界的调用历史"""
+        if self.server.history_size <= 0:
+            return
+        history = self.history.get(name)
+        if history is None or history.maxlen != self.server.history_size:
+            history = deque(history or [], maxlen=self.server.history_size)
+            self.history[name] = history
+        history.append(entry)
+    
+    def get_history(self, name: str, limit: int = 0) -> List[dict]:
+        """最近的调用记录（新的在前）"""
+        entries = list(reversed(self.history.get(name, [])))
+        return entries[:limit] if limit > 0 else entries
+    
+    async def _call_tool(self, name: str, tool: str, arguments: dict,
+                         ctx: Optional[CallContext] = None) -> dict:
+        if self.server.read_only:
+            await self._check_read_only(name, tool)
+        
+        if name in self.config and not self.tool_allowed(name, tool):
+            raise web.HTTPForbidden(text=f"Tool {tool} is not allowed on {name}")
+        
+        # 参数按工具 schema 校验：先确保工具列表已获取（缓存未命中时拉取），再合并默认参数并校验
+        if ctx and ctx.overrides:
+            running = await self.instance(name, ctx.overrides)
+            await self._check_tool_exists(name, tool, running)
+            arguments = self.prepare_arguments(name, tool, arguments, ctx)
+            return await self._call(running, tool, arguments,
+                                    self.tool_timeout(name, tool, ctx), self._call_meta(name, ctx))
+        
+        if name in self.config and self.config[self._runtime(name)].ephemeral:
+            return await self._call_ephemeral(name, tool, arguments, ctx)
+        
+        await self.ensure_started(name)
+        if not self._members(name):
+            raise service_not_running(name, web.HTTPBadRequest)
+        
+        await self._check_tool_exists(name, tool)
+        arguments = self.prepare_arguments(name, tool, arguments, ctx)
+        return await self._call(self._pick(name), tool, arguments,
+                                self.tool_timeout(name, tool, ctx), self._call_meta(name, ctx))
+    
+    async def ensure_started(self, name: str) -> None:
+        """startOnBoot: false 的服务在首次使用时启动；启动中的服务等待本次启动完成"""
+        status = self.get_status(name)
+        if status == "starting" or (self.starts_on_demand(name) and status == "stopped"):
+            if not await self.start_service(name):
+                raise web.HTTPServiceUnavailable(text=f"Failed to start {name}")
+    
+    def starts_on_demand(self, name: str) -> bool:
+        """服务是否在调用时按需启动（临时模式或 startOnBoot: false），停止状态不代表不可调用"""
+        if name not in self.config:
+            return False
+        runtime = self.config[self._runtime(name)]
+        return runtime.ephemeral or not runtime.start_on_boot
+    
+    async def _check_read_only(self, name: str, tool: str) -> None:
+        """只读模式：工具须配置 readOnly 或声明 readOnlyHint（缓存未命中时在有限时间内拉取工具列表）"""
+        tool_cfg = self.config[name].tools.get(tool) if name in self.config else None
+        if tool_cfg and tool_cfg.read_only:
+            return
+        tools = self.tools.get(name)
+        if tools is None or not any(t.get("name") == tool for t in tools):
+            try:
+                tools = await asyncio.wait_for(asyncio.shield(self.list_tools(name)), TOOLS_FETCH_TIMEOUT)
+            except (asyncio.TimeoutError, web.HTTPException):
+                tools = []
+        declared = next((t for t in tools if t.get("name") == tool), None)
+        if not tool_hints(declared)["readOnlyHint"]:
+            raise web.HTTPForbidden(
+                text=f"Gateway is read-only: tool {tool} is not marked readOnly or annotated readOnlyHint")
+    
+    async def _check_tool_exists(self, name: str, tool: str, running: Optional[RunningMCP] = None) -> None:
+        """按已发现的工具列表校验工具名（缓存未命中时刷新一次，可指定从哪个进程拉取）；无法获取工具列表时跳过"""
+        if any(t.get("name") == tool for t in self.tools.get(name, [])):
+            return
+        try:
+            tools = await asyncio.wait_for(asyncio.shield(self.list_tools(name, running)), TOOLS_FETCH_TIMEOUT)
+        except (asyncio.TimeoutError, web.HTTPException):
+            return
+        names = [t.get("name") for t in tools]
+        if not names or tool in names:
+            return
+        raise error_response(web.HTTPNotFound, "TOOL_NOT_FOUND",
+                             f"Tool {tool} not found on {name}; available tools: {', '.join(names)}",
+                             service=name, tool=tool, availableTools=names)
+    
+    async def _call_ephemeral(self, name: str, tool: str, arguments: dict,
+                              ctx: Optional[CallContext] = None) -> dict:
+        """临时模式：启动新进程 → 初始化 → 单次调用 → 销毁"""
+        # 优先使用预热进程，用后即弃并在后台补充
+        runtime = self._runtime(name)
+        spares = self.pools.get(runtime, [])
+        while spares and spares[0].process.poll() is not None:
+            spares.pop(0)
+        running = spares.pop(0) if spares else None
+        if self.config[runtime].pool_size > 0:
+            asyncio.create_task(self._refill(runtime))
+        
+        try:
+            if running is None:
+                running = await self._spawn(self.config[runtime])
+                await self._initialize(running)
+            await self._check_tool_exists(name, tool, running)
+            arguments = self.prepare_arguments(name, tool, arguments, ctx)
+            return await self._call(running, tool, arguments,
+                                    self.tool_timeout(name, tool, ctx), self._call_meta(name, ctx))
+        except web.HTTPException:
+            raise
+        except Exception as e:
+            raise web.HTTPInternalServerError(text=f"Failed to start {name}: {e}")
+        finally:
+            if running is not None:
+                self._terminate(running.process)
+    
+    def caller_identity(self, api_key: str) -> str:
+        """调用方身份：API Key 配置的 name，未命名时为 Key 的摘要（不暴露 Key 本身）"""
+        if not api_key:
+            return ""
+        return (self.server.api_key_names.get(api_key) or
+                "key-" + hashlib.sha256(api_key.encode()).hexdigest()[:12])
+    
+    def _call_meta(self, name: str, ctx: Optional[CallContext]) -> dict:
+        """tools/call 的 _meta：请求关联 ID，及 forwardCaller 开启时的调用方身份"""
+        meta = {}
+        if REQUEST_ID.get():
+            meta["requestId"] = REQUEST_ID.get()
+        if self.config[name].forward_caller and ctx:
+            caller = self.caller_identity(ctx.api_key)
+            if caller:
+                meta["caller"] = caller
+        return meta
+    
+    async def _call(self, running: RunningMCP, tool: str, arguments: dict,
+                    timeout: float = REQUEST_TIMEOUT, meta: Optional[dict] = None) -> dict:
+        running.busy += 1
+        waited = time.time()
+        try:
+            await self._wait_ready(running)
+            async with running.lock:
+                timings = CALL_TIMINGS.get()
+                if timings is not None:
+                    timings["queue"] = timings.get("queue", 0.0) + time.time() - waited
+                return await self._call_locked(running, tool, arguments, timeout, meta)
+        finally:
+            running.busy -= 1
+    
+    async def _wait_ready(self, running: RunningMCP) -> None:
+        """等待进程完成初始化握手，超过 READY_TIMEOUT 返回 503"""
+        if running.ready.is_set():
+            return
+        try:
+            await asyncio.wait_for(running.ready.wait(), READY_TIMEOUT)
+        except asyncio.TimeoutError:
+            raise error_response(web.HTTPServiceUnavailable, "NOT_READY",
+                                 f"Service {running.name} is still initializing",
+                                 service=running.name, headers={"Retry-After": "1"})
+    
+    async def _call_locked(self, running: RunningMCP, tool: str, arguments: dict,
+                           timeout: float = REQUEST_TIMEOUT, meta: Optional[dict] = None) -> dict:
+        try:
+            params = {"name": tool, "arguments": arguments}
+            if meta:
+                params["_meta"] = meta
+            return await self._request(running, "tools/call", params, timeout=timeout)
+        except MCPError as e:
+            raise e.response(web.HTTPInternalServerError, e.message)
+        except asyncio.TimeoutError:
+            raise error_response(web.HTTPGatewayTimeout, "CALL_TIMEOUT",
+                                 f"No response from MCP within {timeout:g}s", timeout=timeout)
+        except OSError as e:
+            # 进程已退出但尚未被回收时写入 stdin 会得到 BrokenPipeError
+            log(f"{running.name}: write failed: {e}")
+            raise service_not_running(running.name, web.HTTPBadGateway)
+    
+    async def health_loop(self) -> None:
+        """周期性并发探测配置了 healthCheck.url 的运行中服务"""
+        while True:
+            targets = [name for name, svc in self.config.items()
+                       if svc.health_check and self.get_status(name) == "running"]
+            await asyncio.gather(*(self._probe(self.http_session(), name) for name in targets))
+            
+            # 加入抖动，避免多个实例同时探测
+            interval = self.server.health_check_interval
+            await asyncio.sleep(interval + random.uniform(0, interval * 0.1))
+    
+    async def _probe(self, session, name: str) -> None:
+        """探测单个服务；超时同样计为失败"""
+        hc = self.config[name].health_check
+        state = self.health.setdefault(name, HealthState())
+        error = ""
+        try:
+            timeout = aiohttp.ClientTimeout(total=hc.timeout)
+            async with session.get(hc.url, headers=self.config[name].headers, timeout=timeout) as resp:
+                if resp.status >= 400:
+                    error = f"HTTP {resp.status}"
+        except asyncio.TimeoutError:
+            error = f"timeout after {hc.timeout:g}s"
+        except Exception as e:
+            error = str(e) or type(e).__name__
         
-        await asyncio.sleep(5)
+        state.last_checked = time.time()
+        state.last_error = error
+        if not error:
+            if not state.healthy:
+                log(f"{name} is healthy again")
+                self.events.publish("healthy", name)
+            state.failures = 0
+            state.healthy = True
+            return
         
-        line = running.process.stdout.readline()
-        if line:
-            resp = json.loads(line)
-            if "result" in resp:
-                return resp["result"]
-            if "error" in resp:
-                raise web.HTTPInternalServerError(text=str(resp["error"]))
+        state.failures += 1
+        if state.healthy and state.failures >= hc.unhealthy_threshold:
+            state.healthy = False
+            log(f"{name} is unhealthy: {error}")
+            self.events.publish("unhealthy", name, error=error)
+    
+    def get_health(self, name: str) -> Optional[dict]:
+        """健康检查结果（未配置时为 None）"""
+        if not self.config[name].health_check:
+            return None
+        state = self.health.get(name, HealthState())
+        return {
+            "healthy": state.healthy,
+            "failures": state.failures,
+            "lastChecked": state.last_checked or None,
+            "lastError": state.last_error or None,
+        }
+    
+    async def self_test(self, name: str) -> dict:
+        """启动 → 初始化 → tools/list → 停止，返回结果与耗时；失败时附带 stderr 末尾"""
+        svc = self.config[name]
+        started = time.time()
+        running = None
+        error = ""
+        tools = None
+        try:
+            running = await self._spawn(svc)
+            await self._initialize(running)
+            tools = await self._paginate(name, running, "tools/list", "tools")
+            if tools is None:
+                error = "tools/list failed"
+        except web.HTTPException as e:
+            error = error_message(e)
+        except asyncio.TimeoutError:
+            error = f"initialize timed out after {1 + svc.init_retries} attempt(s) of {svc.init_timeout:g}s"
+        except Exception as e:
+            error = str(e) or type(e).__name__
+        finally:
+            if running is not None:
+                self._terminate(running.process)
         
-        raise web.HTTPInternalServerError(text="No response from MCP")
+        result = {"service": name, "ok": not error, "seconds": round(time.time() - started, 2)}
+        if error:
+            result["error"] = error
+            # 等待 stderr 读取线程收尾
+            await asyncio.sleep(0.1)
+            result["stderr"] = [line for _, line in list(running.stderr)[-20:]] if running else []
+        else:
+            result["tools"] = len(tools)
+        return result
     
     async def auto_start(self) -> None:
-        """自动启动所有启用的服务"""
-        for name, svc in self.config.items():
-            if svc.enabled:
-                await self.start_service(name)
+        """自动启动所有启用的服务（并发数受 maxConcurrentStarts 限制），通过事件流报告进度"""
+        names = [name for name, svc in self.config.items()
+                 if svc.enabled and svc.start_on_boot and not svc.alias_of]
+        done = 0
+        ready = 0
+        
+        async def start(name: str) -> None:
+            nonlocal done, ready
+            ok = False
+            try:
+                ok = await self.start_service(name)
+            except web.HTTPException as e:
+                log(f"Failed to start {name}: {error_message(e)}")
+            done += 1
+            ready += ok
+            self.events.publish("startup", name, ok=ok, done=done, total=len(names))
+        
+        await asyncio.gather(*(start(name) for name in names))
+        lazy = sum(1 for svc in self.config.values()
+                   if svc.enabled and not svc.start_on_boot and not svc.alias_of)
+        log(f"{ready}/{len(names)} services ready" + (f", {lazy} start on demand" if lazy else ""))
 
 
 # ==================== 全局管理器 ====================
@@ -263,6 +2778,167 @@ manager = MCPManager()
 
 # ==================== 请求处理 ====================
 
+def request_api_key(request) -> str:
+    """从 X-API-Key 或 Authorization: Bearer 中提取 API Key"""
+    api_key = request.headers.get("X-API-Key", "")
+    auth = request.headers.get("Authorization", "")
+    if not api_key and auth.startswith("Bearer "):
+        api_key = auth[7:].strip()
+    return api_key
+
+
+def api_key_valid(given: str, keys: List[str]) -> bool:
+    """常量时间比较 API Key；按字节比较，非 ASCII 的请求头值视为无效而不是报错"""
+    given_bytes = given.encode(errors="surrogateescape")
+    return any(hmac.compare_digest(given_bytes, k.encode(errors="surrogateescape")) for k in keys)
+
+
+def call_context(request) -> CallContext:
+    """从请求中提取调用上下文"""
+    return CallContext(api_key=request_api_key(request), timeout=request_call_timeout(request))
+
+
+def request_call_timeout(request) -> float:
+    """解析 X-MCP-Timeout 请求头：格式错误或非正数返回 400，超过 server.maxCallTimeout 时截断"""
+    value = request.headers.get("X-MCP-Timeout", "")
+    if not value:
+        return 0.0
+    try:
+        timeout = parse_duration(value, 0.0)
+    except ValueError:
+        raise web.HTTPBadRequest(text=f"Invalid X-MCP-Timeout: {value}")
+    if timeout <= 0:
+        raise web.HTTPBadRequest(text=f"Invalid X-MCP-Timeout: {value}")
+    limit = manager.server.max_call_timeout
+    if limit and timeout > limit:
+        log(f"X-MCP-Timeout {value} exceeds maxCallTimeout, clamped to {limit:g}s")
+        timeout = limit
+    return timeout
+
+
+@web.middleware
+async def request_id_middleware(request, handler):
+    """接受或生成 X-Request-ID，写入日志上下文并在响应头中回显"""
+    request_id = request.headers.get("X-Request-ID", "")
+    if not REQUEST_ID_RE.match(request_id):
+        request_id = uuid.uuid4().hex
+    REQUEST_ID.set(request_id)
+    try:
+        response = await handler(request)
+    except web.HTTPException as e:
+        e.headers["X-Request-ID"] = request_id
+        raise
+    response.headers["X-Request-ID"] = request_id
+    return response
+
+
+def prettify(response: web.Response) -> None:
+    """将 JSON 响应体改写为缩进格式（非 JSON 或无法解析时保持原样）"""
+    if response.content_type != "application/json":
+        return
+    try:
+        data = json.loads(response.text)
+    except (ValueError, TypeError):
+        return
+    response.text = json.dumps(data, ensure_ascii=False, indent=2) + "\n"
+
+
+@web.middleware
+async def pretty_middleware(request, handler):
+    """?pretty=true 时以缩进格式输出 JSON（含错误响应），默认保持紧凑"""
+    if request.query.get("pretty", "").lower() not in ("1", "true", "yes"):
+        return await handler(request)
+    try:
+        response = await handler(request)
+    except web.HTTPException as e:
+        prettify(e)
+        raise
+    if isinstance(response, web.Response):
+        prettify(response)
+    return response
+
+
+@web.middleware
+async def cors_middleware(request, handler):
+    """CORS：预检请求按路由实际支持的方法应答（不需要认证），其余响应附带 Allow-Origin"""
+    cors = manager.cors
+    origin = request.headers.get("Origin", "")
+    if not cors.origin_allowed(origin):
+        return await handler(request)
+    allow_origin = {
+        "Access-Control-Allow-Origin": "*" if "*" in cors.allowed_origins else origin,
+        "Vary": "Origin",
+    }
+    
+    if request.method == "OPTIONS" and "Access-Control-Request-Method" in request.headers:
+        # 未注册 OPTIONS 路由：已知路径解析为 405（附带实际支持的方法），未知路径为 404
+        exc = request.match_info.http_exception
+        if isinstance(exc, web.HTTPMethodNotAllowed):
+            methods = [m for m in sorted(exc.allowed_methods) if m in cors.allowed_methods]
+        elif exc is None:
+            methods = list(cors.allowed_methods)
+        else:
+            raise exc
+        return web.Response(status=204, headers={
+            **allow_origin,
+            "Access-Control-Allow-Methods": ", ".join(methods),
+            "Access-Control-Allow-Headers": ", ".join(cors.allowed_headers),
+            "Access-Control-Max-Age": f"{cors.max_age:.0f}",
+        })
+    
+    allow_origin["Access-Control-Expose-Headers"] = "X-Request-ID"
+    try:
+        response = await handler(request)
+    except web.HTTPException as e:
+        e.headers.update(allow_origin)
+        raise
+    response.headers.update(allow_origin)
+    return response
+
+
+def route_path(request) -> str:
+    """去掉 server.basePath 前缀后的请求路径"""
+    base = manager.server.base_path
+    path = request.path
+    return (path[len(base):] or "/") if base and path.startswith(base) else path
+
+
+# 长连接接口不受 requestTimeout 限制
+STREAMING_PATHS = ("/api/v1/events",)
+
+
+@web.middleware
+async def limits_middleware(request, handler):
+    """服务端加固：并发请求上限、请求体大小上限、请求处理超时（SSE 除外）"""
+    cfg = manager.server
+    if cfg.max_concurrent_requests and manager.active_requests >= cfg.max_concurrent_requests:
+        raise web.HTTPServiceUnavailable(text="Too many concurrent requests", headers={"Retry-After": "1"})
+    if request.content_length and request.content_length > cfg.max_body_size:
+        raise web.HTTPRequestEntityTooLarge(max_size=cfg.max_body_size, actual_size=request.content_length)
+    
+    manager.active_requests += 1
+    try:
+        if cfg.request_timeout and route_path(request) not in STREAMING_PATHS:
+            try:
+                return await asyncio.wait_for(handler(request), cfg.request_timeout)
+            except asyncio.TimeoutError:
+                raise web.HTTPServiceUnavailable(text=f"Request not completed within {cfg.request_timeout:g}s")
+        return await handler(request)
+    finally:
+        manager.active_requests -= 1
+
+
+@web.middleware
+async def auth_middleware(request, handler):
+    """配置了 server.apiKeys 时，/api/ 下的接口需要携带有效的 API Key"""
+    keys = manager.server.api_keys
+    if keys and route_path(request).startswith("/api/"):
+        given = request_api_key(request)
+        if not api_key_valid(given, keys):
+            raise web.HTTPUnauthorized(text="Missing or invalid API key")
+    return await handler(request)
+
+
 async def health(request):
     """健康检查"""
     running = sum(1 for name in manager.config if manager.get_status(name) == "running")
@@ -271,14 +2947,46 @@ async def health(request):
         "status": "healthy",
         "version": "1.0.0",
         "services_total": len(manager.config),
-        "services_running": running
+        "services_running": running,
+        "runtimes": manager.runtimes
     })
 
 
-async def list_services(request):
-    """获取所有服务"""
+async def health_summary(request):
+    """服务状态汇总（仅读取内存状态，不触发探测）"""
+    statuses = {name: manager.get_status(name) for name in manager.config}
+    return web.json_response({
+        "total": len(statuses),
+        "running": sum(1 for s in statuses.values() if s == "running"),
+        "starting": sum(1 for s in statuses.values() if s == "starting"),
+        "stopped": sum(1 for s in statuses.values() if s == "stopped"),
+        "ephemeral": sum(1 for s in statuses.values() if s == "ephemeral"),
+        "unhealthy": sum(1 for name, s in statuses.items() if s == "running"
+                         and name in manager.health and not manager.health[name].healthy),
+        "initFailed": sum(1 for name in statuses if name in manager.start_errors),
+        "dockerAvailable": manager.runtimes.get("docker", False),
+    })
+
+
+def select_services(request) -> List[str]:
+    """按 ?label=k=v（可重复，需全部匹配）与 ?tag=x（可重复，需全部包含）筛选服务"""
+    labels = []
+    for item in request.query.getall("label", []):
+        key, sep, value = item.partition("=")
+        if not key or not sep:
+            raise web.HTTPBadRequest(text=f"label filter must be key=value: {item}")
+        labels.append((key, value))
+    tags = request.query.getall("tag", [])
+    
+    return [name for name, svc in manager.config.items()
+            if all(svc.labels.get(k) == v for k, v in labels) and all(t in svc.tags for t in tags)]
+
+
+def service_summaries(names: Optional[List[str]] = None) -> List[dict]:
+    """服务列表数据（API 与服务端渲染共用）"""
     result = []
-    for name, svc in manager.config.items():
+    for name in manager.config if names is None else names:
+        svc = manager.config[name]
         status = manager.get_status(name)
         
         result.append({
@@ -286,10 +2994,21 @@ async def list_services(request):
             "displayName": svc.display_name,
             "description": svc.description,
             "status": status,
-            "port": svc.port if status == "running" else None
+            "port": manager.config[manager._runtime(name)].port if status == "running" else None,
+            "aliasOf": svc.alias_of or None,
+            "labels": svc.labels,
+            "tags": svc.tags,
+            "callCount": manager.call_counts.get(name, 0),
+            "lastCallAt": manager.last_call_at.get(name),
+            "health": manager.get_health(name),
+            "configDrift": name in manager.drift
         })
-    
-    return web.json_response({"services": result})
+    return result
+
+
+async def list_services(request):
+    """获取服务列表（支持 label/tag 筛选）"""
+    return web.json_response({"services": service_summaries(select_services(request))})
 
 
 async def get_service(request):
@@ -297,31 +3016,491 @@ async def get_service(request):
     name = request.match_info['name']
     
     if name not in manager.config:
-        raise web.HTTPNotFound(text=f"Service {name} not found")
+        raise service_not_found(name)
     
     svc = manager.config[name]
     status = manager.get_status(name)
     
-    # 获取工具列表
-    tools = []
+    # 获取工具列表：服务无响应时不阻塞详情，返回缓存并标记为过期
+    tools, stale = [], False
     if status == "running":
-        tools = await manager.list_tools(name)
+        try:
+            tools = await asyncio.wait_for(asyncio.shield(manager.list_tools(name)), TOOLS_FETCH_TIMEOUT)
+        except asyncio.TimeoutError:
+            tools, stale = manager.tools.get(name, []), True
     
     return web.json_response({
         "name": name,
         "displayName": svc.display_name,
         "description": svc.description,
         "status": status,
-        "tools": tools
+        "aliasOf": svc.alias_of or None,
+        "tools": tools,
+        "toolsStale": stale,
+        "callCount": manager.call_counts.get(name, 0),
+        "lastCallAt": manager.last_call_at.get(name),
+        "pool": manager.pool_stats(name),
+        "instances": [{"overrides": json.loads(k), "pid": m.process.pid, "busy": m.busy}
+                      for k, m in manager.instances.get(manager._runtime(name), {}).items()],
+        "limits": manager.limit_stats(name),
+        "health": manager.get_health(name),
+        "configDrift": name in manager.drift
+    })
+
+
+async def get_tool_schema(request):
+    """获取工具的输入/输出 JSON Schema"""
+    name = request.match_info['name']
+    tool = request.match_info['tool']
+    
+    if name not in manager.config:
+        raise service_not_found(name)
+    
+    t = await manager.get_tool(name, tool)
+    if t is None:
+        raise web.HTTPNotFound(text=f"Tool {tool} not found in {name}")
+    
+    result = {
+        "service": name,
+        "tool": tool,
+        "title": t.get("title") or (t.get("annotations") or {}).get("title"),
+        "annotations": t.get("annotations") or {},
+        "hints": tool_hints(t),
+        "inputSchema": t.get("inputSchema", {"type": "object"}),
+        "timeout": manager.tool_timeout(name, tool),
+    }
+    if "outputSchema" in t:
+        result["outputSchema"] = t["outputSchema"]
+    return web.json_response(result)
+
+
+SSE_HEARTBEAT = 15
+
+
+async def events(request):
+    """SSE 推送服务状态变化（定期发送注释行保持连接）；?events= 逗号分隔选择事件类型，默认推送生命周期与工具列表变化事件"""
+    kinds = LIFECYCLE_EVENTS | CATALOG_EVENTS
+    if request.query.get("events"):
+        kinds = frozenset(e.strip() for e in request.query["events"].split(",") if e.strip())
+        unknown = kinds - LIFECYCLE_EVENTS - TOOL_EVENTS - CATALOG_EVENTS
+        if unknown:
+            raise error_response(
+                web.HTTPBadRequest, "INVALID_EVENTS",
+                f"Unknown event types: {', '.join(sorted(unknown))}",
+                available=sorted(LIFECYCLE_EVENTS | TOOL_EVENTS | CATALOG_EVENTS)
+            )
+    
+    resp = web.StreamResponse(headers={
+        "Content-Type": "text/event-stream",
+        "Cache-Control": "no-cache",
+        "X-Accel-Buffering": "no",
+    })
+    await resp.prepare(request)
+    
+    queue = manager.events.subscribe(kinds)
+    try:
+        while True:
+            try:
+                message = await asyncio.wait_for(queue.get(), timeout=SSE_HEARTBEAT)
+            except asyncio.TimeoutError:
+                await resp.write(b": heartbeat\n\n")
+                continue
+            payload = json.dumps(message, ensure_ascii=False)
+            await resp.write(f"event: {message['event']}\ndata: {payload}\n\n".encode())
+    except (ConnectionResetError, asyncio.CancelledError):
+        pass
+    finally:
+        manager.events.unsubscribe(queue)
+    return resp
+
+
+async def ping_service(request):
+    """检测单个服务是否响应（MCP ping）"""
+    name = request.match_info['name']
+    
+    if name not in manager.config:
+        raise service_not_found(name)
+    
+    result = await manager.ping(name)
+    return web.json_response({"success": True, **result})
+
+
+async def complete(request):
+    """参数自动补全：{"ref": {"type": "ref/prompt", "name": ...}, "argument": {"name": ..., "value": ...}}"""
+    name = request.match_info['name']
+    
+    if name not in manager.config:
+        raise service_not_found(name)
+    
+    try:
+        data = await request.json()
+    except:
+        raise web.HTTPBadRequest(text="Invalid JSON")
+    
+    ref = data.get("ref")
+    argument = data.get("argument")
+    if not isinstance(ref, dict) or ref.get("type") not in ("ref/prompt", "ref/resource"):
+        raise web.HTTPBadRequest(text="ref must be an object with type ref/prompt or ref/resource")
+    if not isinstance(argument, dict) or not argument.get("name"):
+        raise web.HTTPBadRequest(text="argument must be an object with name and value")
+    
+    result = await manager.complete(name, ref, {"name": argument["name"],
+                                                "value": str(argument.get("value", ""))})
+    return web.json_response({"success": True, **result})
+
+
+async def get_logs(request):
+    """获取缓冲的 stderr 日志：?tail=N ?since=5m ?grep=子串 ?format=text|json"""
+    name = request.match_info['name']
+    
+    if name not in manager.config:
+        raise service_not_found(name)
+    
+    fmt = request.query.get("format", "json")
+    if fmt not in ("text", "json"):
+        raise web.HTTPBadRequest(text="format must be text or json")
+    try:
+        tail = int(request.query.get("tail", 0))
+        since = parse_duration(request.query.get("since"), 0.0)
+    except ValueError as e:
+        raise web.HTTPBadRequest(text=str(e))
+    grep = request.query.get("grep", "")
+    
+    entries = manager.get_logs(name)
+    if since:
+        cutoff = time.time() - since
+        entries = [e for e in entries if e["time"] >= cutoff]
+    if grep:
+        entries = [e for e in entries if grep in e["line"]]
+    if tail > 0:
+        entries = entries[-tail:]
+    
+    if fmt == "text":
+        return web.Response(text="".join(e["line"] + "\n" for e in entries))
+    return web.json_response({"service": name, "logs": entries})
+
+
+async def get_initialize(request):
+    """获取 initialize 握手的原始响应（可能暴露服务端内部信息：需 API Key，未配置时仅限本机直连访问）"""
+    name = request.match_info['name']
+    
+    if name not in manager.config:
+        raise service_not_found(name)
+    # 反向代理后 request.remote 是代理的地址：部署在代理后（basePath / publicUrl / 受信代理）时不按本机放行
+    cfg = manager.server
+    behind_proxy = bool(cfg.base_path or cfg.public_url) or from_trusted_proxy(request)
+    if not cfg.api_keys and (behind_proxy or not is_loopback(request.remote or "")):
+        raise web.HTTPForbidden(text="initialize result is only available to local clients unless server.apiKeys is set "
+                                     "(required behind a reverse proxy)")
+    
+    processes = manager.initialize_results(name)
+    if not processes:
+        raise service_not_running(name)
+    return web.json_response({"service": name, "processes": processes})
+
+
+async def get_metrics(request):
+    """Prometheus 文本格式的调用耗时直方图（按服务与阶段）"""
+    return web.Response(text=manager.latency.render("clawmcp_tool_call_duration_seconds"),
+                        headers={"Content-Type": "text/plain; version=0.0.4; charset=utf-8"})
+
+
+async def get_history(request):
+    """获取最近的工具调用历史"""
+    name = request.match_info['name']
+    
+    if name not in manager.config:
+        raise service_not_found(name)
+    
+    try:
+        limit = int(request.query.get("limit", "0"))
+    except ValueError:
+        raise web.HTTPBadRequest(text="limit must be an integer")
+    
+    return web.json_response({"history": manager.get_history(name, limit)})
+
+
+async def get_diagnostics(request):
+    """系统诊断信息"""
+    return web.json_response(manager.diagnostics())
+
+
+async def list_resources(request):
+    """获取资源列表"""
+    name = request.match_info['name']
+    
+    if name not in manager.config:
+        raise service_not_found(name)
+    
+    return web.json_response({"resources": await manager.list_resources(name)})
+
+
+RESOURCE_CHUNK_SIZE = 64 * 1024
+
+
+async def read_resource(request):
+    """以原始 mimeType 下载资源内容，支持 Range 请求"""
+    name = request.match_info['name']
+    uri = request.query.get("uri", "")
+    
+    if name not in manager.config:
+        raise service_not_found(name)
+    if not uri:
+        raise web.HTTPBadRequest(text="uri is required")
+    
+    result = await manager.read_resource(name, uri)
+    contents = result.get("contents") or []
+    index = request.query.get("index", "0")
+    if not index.isdigit() or int(index) >= len(contents):
+        raise web.HTTPNotFound(text="Resource content not found")
+    block = contents[int(index)]
+    
+    if block.get("blob") is not None:
+        try:
+            body = base64.b64decode(block["blob"], validate=True)
+        except ValueError:
+            raise web.HTTPBadGateway(text="Resource blob is not valid base64")
+        mime_type = block.get("mimeType") or "application/octet-stream"
+    else:
+        body = str(block.get("text", "")).encode()
+        mime_type = block.get("mimeType") or "text/plain"
+    
+    try:
+        rng = request.http_range
+    except ValueError:
+        raise web.HTTPRequestRangeNotSatisfiable(headers={"Content-Range": f"bytes */{len(body)}"})
+    start, stop, _ = rng.indices(len(body))
+    partial = rng.start is not None or rng.stop is not None
+    if partial and start >= stop:
+        raise web.HTTPRequestRangeNotSatisfiable(headers={"Content-Range": f"bytes */{len(body)}"})
+    
+    response = web.StreamResponse(status=206 if partial else 200, headers={
+        "Content-Type": mime_type,
+        "Content-Disposition": content_disposition(str(block.get("uri", uri)), "resource"),
+        "Accept-Ranges": "bytes",
     })
+    if partial:
+        response.headers["Content-Range"] = f"bytes {start}-{stop - 1}/{len(body)}"
+    response.content_length = stop - start
+    await response.prepare(request)
+    
+    # 分块写出，避免再复制一份完整内容
+    view = memoryview(body)
+    for offset in range(start, stop, RESOURCE_CHUNK_SIZE):
+        await response.write(view[offset:min(offset + RESOURCE_CHUNK_SIZE, stop)])
+    await response.write_eof()
+    return response
+
+
+async def list_prompts(request):
+    """获取提示词列表"""
+    name = request.match_info['name']
+    
+    if name not in manager.config:
+        raise service_not_found(name)
+    
+    return web.json_response({"prompts": await manager.list_prompts(name)})
+
+
+CLIENT_CONFIG_FORMATS = ("claude-desktop", "cursor", "vscode")
+
+
+async def get_client_config(request):
+    """生成客户端 MCP 配置片段：经 scripts/gateway_stdio.py 连接网关中的该服务（而非直接启动上游命令），
+    认证、工具过滤、只读模式、默认参数与调用记录照常生效；API Key 以占位符代替"""
+    name = request.match_info['name']
+    client = request.query.get("client", "claude-desktop")
+    
+    if name not in manager.config:
+        raise service_not_found(name)
+    if client not in CLIENT_CONFIG_FORMATS:
+        raise web.HTTPBadRequest(
+            text=f"Unsupported client {client}, expected one of: {', '.join(CLIENT_CONFIG_FORMATS)}")
+    
+    # 别名按自身的名字经网关调用，使用别名的工具过滤与默认参数
+    server = {
+        "command": "python3",
+        "args": [os.path.join(BASE_DIR, "scripts", "gateway_stdio.py"),
+                 "--url", public_base_url(request), "--service", name],
+    }
+    if manager.server.api_keys:
+        server["env"] = {"CLAWMCP_API_KEY": "<CLAWMCP_API_KEY>"}
+    
+    if client == "vscode":
+        snippet = {"servers": {name: {"type": "stdio", **server}}}
+    else:
+        snippet = {"mcpServers": {name: server}}
+    
+    return web.json_response({"client": client, "config": snippet})
+
+
+FORWARDED_HOST_RE = re.compile(r"^(\[[0-9A-Fa-f:.]+\]|[A-Za-z0-9.-]+)(:\d{1,5})?$")
+
+
+def from_trusted_proxy(request) -> bool:
+    """请求是否来自 server.trustedProxies 中的代理"""
+    try:
+        remote = ipaddress.ip_address(request.remote or "")
+    except ValueError:
+        return False
+    return any(remote in net for net in manager.server.trusted_proxies)
+
+
+def public_base_url(request) -> str:
+    """对外访问的基础 URL：server.publicUrl > 受信代理的 X-Forwarded-Proto/Host > 请求自身的 scheme 与 Host"""
+    cfg = manager.server
+    if cfg.public_url:
+        return cfg.public_url
+    scheme, host = request.scheme, request.host
+    if from_trusted_proxy(request):
+        proto = request.headers.get("X-Forwarded-Proto", "").split(",")[0].strip().lower()
+        forwarded = request.headers.get("X-Forwarded-Host", "").split(",")[0].strip()
+        if proto in ("http", "https"):
+            scheme = proto
+        if FORWARDED_HOST_RE.match(forwarded):
+            host = forwarded
+    return f"{scheme}://{host}{cfg.base_path}"
+
+
+def render_skill(name: str, tools: List[dict], base_url: str) -> str:
+    """根据工具元数据生成 SKILL.md（含 frontmatter），调用方式为网关的 /call 接口"""
+    svc = manager.config[name]
+    description = (svc.description or svc.display_name).replace("\n", " ")
+    lines = [
+        "---",
+        f"name: {name}",
+        f"description: {json.dumps(description, ensure_ascii=False)}",
+        "---",
+        "",
+        f"# {svc.display_name}",
+        "",
+    ]
+    if svc.description:
+        lines += [svc.description, ""]
+    lines += [
+        "通过 ClawMCP Gateway 调用：",
+        "",
+        "```bash",
+        f"curl -X POST {base_url}/api/v1/services/{name}/call \\",
+        "  -H 'Content-Type: application/json' \\",
+        "  -d '{\"tool\": \"<tool>\", \"arguments\": {...}}'",
+        "```",
+        "",
+        "## 工具",
+        "",
+    ]
+    for t in tools:
+        title = t.get("title") or (t.get("annotations") or {}).get("title")
+        lines += [f"### {t.get('name', '')}" + (f"（{title}）" if title else ""), ""]
+        hints = tool_hints(t)
+        if hints["readOnlyHint"]:
+            lines += ["> 只读：不会修改外部状态", ""]
+        elif hints["destructiveHint"]:
+            lines += ["> ⚠️ 可能修改或删除数据，调用前请确认", ""]
+        if t.get("description"):
+            lines += [t["description"].strip(), ""]
+        schema = t.get("inputSchema") or {}
+        required = set(schema.get("required", []))
+        params = schema.get("properties") or {}
+        if params:
+            lines += ["| 参数 | 类型 | 必填 | 说明 |", "|------|------|------|------|"]
+            for key, prop in params.items():
+                prop = prop if isinstance(prop, dict) else {}
+                kind = prop.get("type", "")
+                kind = "/".join(kind) if isinstance(kind, list) else kind
+                text = str(prop.get("description", "")).replace("|", "\\|").replace("\n", " ")
+                lines.append(f"| {key} | {kind} | {'是' if key in required else '否'} | {text} |")
+            lines.append("")
+    return "\n".join(lines)
+
+
+def skill_export_dir(request) -> str:
+    """导出目录：server.skillsDir 下的相对路径（?path=），拒绝越出该目录"""
+    root = manager.server.skills_dir
+    sub = request.query.get("path", "")
+    target = os.path.realpath(os.path.join(root, sub))
+    if os.path.isabs(sub) or os.path.commonpath([target, os.path.realpath(root)]) != os.path.realpath(root):
+        raise web.HTTPBadRequest(text="path must be a relative directory inside server.skillsDir")
+    return target
+
+
+async def write_skill(name: str, base: str, base_url: str) -> str:
+    """生成并写入 <base>/<name>/SKILL.md；按需启动的服务在此启动"""
+    await manager.ensure_started(name)
+    if manager.get_status(name) == "stopped":
+        raise service_not_running(name)
+    content = render_skill(name, await manager.list_tools(name), base_url)
+    path = os.path.join(base, name, "SKILL.md")
+    try:
+        os.makedirs(os.path.dirname(path), exist_ok=True)
+        with open(path, "w") as f:
+            f.write(content)
+    except OSError as e:
+        raise web.HTTPInternalServerError(text=f"Cannot write {path}: {e.strerror}")
+    return path
+
+
+async def get_skill(request):
+    """以 Markdown 返回服务的 SKILL.md"""
+    name = request.match_info['name']
+    if name not in manager.config:
+        raise service_not_found(name)
+    await manager.ensure_started(name)
+    if manager.get_status(name) == "stopped":
+        raise service_not_running(name)
+    content = render_skill(name, await manager.list_tools(name), public_base_url(request))
+    return web.Response(text=content, content_type="text/markdown")
+
+
+async def export_skill(request):
+    """将服务的 SKILL.md 写入 server.skillsDir"""
+    ensure_writable()
+    name = request.match_info['name']
+    if name not in manager.config:
+        raise service_not_found(name)
+    path = await write_skill(name, skill_export_dir(request), public_base_url(request))
+    return web.json_response({"success": True, "path": path})
+
+
+async def export_skills(request):
+    """导出所有运行中（或按需启动）服务的 SKILL.md，生成 skills 目录树"""
+    ensure_writable()
+    base = skill_export_dir(request)
+    written, skipped = {}, {}
+    for name in select_services(request):
+        try:
+            written[name] = await write_skill(name, base, public_base_url(request))
+        except web.HTTPException as e:
+            skipped[name] = error_message(e)
+    return web.json_response({"success": not skipped, "written": written, "skipped": skipped})
+
+
+def ensure_writable() -> None:
+    """只读模式下拒绝会改变状态的操作"""
+    if manager.server.read_only:
+        raise web.HTTPForbidden(text="Gateway is in read-only mode")
 
 
 async def start_service(request):
     """启动服务"""
+    ensure_writable()
     name = request.match_info['name']
     
     if name not in manager.config:
-        raise web.HTTPNotFound(text=f"Service {name} not found")
+        raise service_not_found(name)
+    
+    # 请求体带 overrides 时预先启动对应的参数化实例
+    data = {}
+    if request.can_read_body:
+        try:
+            data = await request.json()
+        except ValueError:
+            raise web.HTTPBadRequest(text="Invalid JSON")
+    overrides = manager.validate_overrides(name, data.get("overrides") if isinstance(data, dict) else None)
+    if overrides:
+        running = await manager.instance(name, overrides)
+        return web.json_response({"success": True, "message": f"{name} instance started",
+                                  "pid": running.process.pid})
     
     success = await manager.start_service(name)
     
@@ -331,65 +3510,450 @@ async def start_service(request):
     raise web.HTTPInternalServerError(text=f"Failed to start {name}")
 
 
+async def start_services(request):
+    """批量启动（按 label/tag 筛选，未指定时为全部）"""
+    ensure_writable()
+    names = [n for n in select_services(request) if not manager.config[n].alias_of]
+    
+    async def start(name: str) -> bool:
+        try:
+            return await manager.start_service(name)
+        except web.HTTPException:
+            return False
+    
+    results = await asyncio.gather(*(start(n) for n in names))
+    return web.json_response({"success": all(results), "results": dict(zip(names, results))})
+
+
+async def stop_services(request):
+    """批量停止（按 label/tag 筛选，未指定时为全部）"""
+    ensure_writable()
+    names = [n for n in select_services(request) if not manager.config[n].alias_of]
+    for name in names:
+        await manager.stop_service(name)
+    return web.json_response({"success": True, "stopped": names})
+
+
 async def stop_service(request):
     """停止服务"""
+    ensure_writable()
     name = request.match_info['name']
     
     await manager.stop_service(name)
     return web.json_response({"success": True, "message": f"{name} stopped"})
 
 
+MULTIPART_ARG_PREFIX = "arguments."
+
+
+async def read_call_body(request) -> dict:
+    """读取 /call 请求体：JSON，或 multipart/form-data（request 部分为 JSON 请求体，
+    arguments.<name> 部分以 UTF-8 文本注入同名参数，避免把大段文本转义进 JSON）"""
+    if request.content_type != "multipart/form-data":
+        try:
+            return await request.json()
+        except:
+            raise web.HTTPBadRequest(text="Invalid JSON")
+    
+    # multipart 不受 client_max_size 约束，分块请求也没有 Content-Length：逐块读取并累计大小
+    limit = min(manager.server.max_body_size, MAX_BODY_SIZE_LIMIT)
+    total = 0
+    
+    async def read_part(part) -> bytes:
+        nonlocal total
+        chunks = []
+        while True:
+            chunk = await part.read_chunk()
+            if not chunk:
+                break
+            total += len(chunk)
+            if total > limit:
+                raise web.HTTPRequestEntityTooLarge(max_size=limit, actual_size=total)
+            chunks.append(chunk)
+        return part.decode(b"".join(chunks))
+    
+    data, fields = None, {}
+    reader = await request.multipart()
+    async for part in reader:
+        if part.name == "request":
+            try:
+                data = json.loads(await read_part(part))
+            except ValueError:
+                raise web.HTTPBadRequest(text="Invalid JSON in multipart part 'request'")
+        elif part.name and part.name.startswith(MULTIPART_ARG_PREFIX) and len(part.name) > len(MULTIPART_ARG_PREFIX):
+            try:
+                fields[part.name[len(MULTIPART_ARG_PREFIX):]] = (await read_part(part)).decode("utf-8")
+            except UnicodeDecodeError:
+                raise web.HTTPBadRequest(text=f"Multipart part '{part.name}' is not valid UTF-8 text")
+        else:
+            raise web.HTTPBadRequest(
+                text=f"Unexpected multipart part '{part.name}': expected 'request' or '{MULTIPART_ARG_PREFIX}<name>'")
+    
+    if not isinstance(data, dict):
+        raise web.HTTPBadRequest(text="multipart call requires a JSON part named 'request'")
+    arguments = data.setdefault("arguments", {})
+    if isinstance(arguments, dict):
+        duplicated = sorted(set(arguments) & set(fields))
+        if duplicated:
+            raise web.HTTPBadRequest(text=f"Arguments given both in JSON and as multipart parts: {', '.join(duplicated)}")
+        arguments.update(fields)
+    return data
+
+
 async def call_tool(request):
-    """调用工具"""
+    """调用工具（JSON 或 multipart/form-data 请求体）"""
     name = request.match_info['name']
     
     if name not in manager.config:
-        raise web.HTTPNotFound(text=f"Service {name} not found")
+        raise service_not_found(name)
+    
+    data = await read_call_body(request)
+    
+    tool = data.get("tool")
+    arguments = data.get("arguments", {})
+    
+    if not tool:
+        raise web.HTTPBadRequest(text="tool is required")
+    if not isinstance(arguments, dict):
+        raise web.HTTPBadRequest(text="arguments must be an object")
+    
+    # 预演：校验并合并默认参数，返回将要发送的 JSON-RPC 请求，不转发给 MCP 服务
+    if request.query.get("dryRun", "").lower() in ("1", "true"):
+        known = await manager.get_tool(name, tool) is not None
+        arguments = manager.prepare_arguments(name, tool, arguments, call_context(request))
+        return web.json_response({
+            "success": True,
+            "dryRun": True,
+            "validated": known,
+            "request": {
+                "jsonrpc": "2.0",
+                "id": None,
+                "method": "tools/call",
+                "params": {"name": tool, "arguments": arguments}
+            }
+        })
     
+    # ?resultMode=：auto 按工具的 outputSchema 决定是否返回 structuredContent，structured / text 按结果形态转换（无法转换时标记 degraded）
+    result_mode = request.query.get("resultMode", "auto")
+    if result_mode not in RESULT_MODES:
+        raise web.HTTPBadRequest(text=f"resultMode must be one of {', '.join(RESULT_MODES)}")
+    
+    # ?select=：在服务端按 JSONPath 子集截取结果
+    select = request.query.get("select", "")
+    segments = None
+    if select:
+        try:
+            segments = parse_select(select)
+        except ValueError as e:
+            raise web.HTTPBadRequest(text=f"Invalid select expression: {e}")
+    
+    ctx = call_context(request)
+    ctx.overrides = manager.validate_overrides(name, data.get("overrides"))
+    result = await manager.call_tool(name, tool, arguments, ctx)
+    declared = next((t for t in manager.tools.get(name, []) if t.get("name") == tool), None)
+    shaped, info = shape_result(result, result_mode, bool(declared and declared.get("outputSchema")))
+    if segments is not None:
+        # auto 模式下 select 路径相对原始结果（如 $.structuredContent.items）
+        if result_mode == "auto":
+            shaped, info = result, {}
+        return web.json_response({"success": True, "select": select,
+                                  "result": select_path(shaped, segments), **info})
+    response = {"success": True, "result": shaped, **info}
+    if result_mode != "auto":
+        response["resultMode"] = result_mode
+    request_id = manager.retain_result(name, result)
+    if request_id:
+        response["requestId"] = request_id
+    return web.json_response(response)
+
+
+async def fan_out_call(request):
+    """在多个服务上并发调用同一工具，按服务返回结果或错误"""
     try:
         data = await request.json()
     except:
         raise web.HTTPBadRequest(text="Invalid JSON")
     
+    services = data.get("services")
     tool = data.get("tool")
     arguments = data.get("arguments", {})
     
     if not tool:
         raise web.HTTPBadRequest(text="tool is required")
+    if not isinstance(services, list) or not services:
+        raise web.HTTPBadRequest(text="services must be a non-empty list")
+    if not isinstance(arguments, dict):
+        raise web.HTTPBadRequest(text="arguments must be an object")
+    
+    ctx = call_context(request)
+    
+    async def call_one(name: str) -> dict:
+        if name not in manager.config:
+            return {"success": False, "status": 404, "error": f"Service {name} not found"}
+        # 按需启动的服务与单次调用一样在此启动；只有常驻服务被停止时返回 409
+        if manager.get_status(name) == "stopped" and not manager.starts_on_demand(name):
+            return {"success": False, "status": 409, "error": f"Service {name} not running"}
+        try:
+            result = await manager.call_tool(name, tool, arguments, ctx)
+        except web.HTTPException as e:
+            return {"success": False, "status": e.status, "error": error_message(e)}
+        except Exception as e:
+            return {"success": False, "status": 500, "error": str(e) or type(e).__name__}
+        return {"success": True, "result": result}
+    
+    names = list(dict.fromkeys(str(n) for n in services))
+    results = await asyncio.gather(*(call_one(n) for n in names))
+    return web.json_response({"success": True, "results": dict(zip(names, results))})
+
+
+async def get_call_content(request):
+    """以原始 mimeType 下载调用结果中的二进制内容块"""
+    name = request.match_info['name']
+    result = manager.get_result(name, request.match_info['request_id'])
+    if result is None:
+        raise web.HTTPNotFound(text="Result not found or expired")
+    
+    index = request.match_info['index']
+    if not index.isdigit() or int(index) >= len(result["content"]):
+        raise web.HTTPNotFound(text="Content block not found")
+    block = result["content"][int(index)]
+    blob = content_blob(block)
+    if blob is None:
+        raise web.HTTPNotFound(text="Content block has no binary data")
+    
+    data, mime_type = blob
+    try:
+        body = base64.b64decode(data, validate=True)
+    except ValueError:
+        raise web.HTTPBadGateway(text="Content block is not valid base64")
     
-    result = await manager.call_tool(name, tool, arguments)
-    return web.json_response({"success": True, "result": result})
+    uri = str((block.get("resource") or {}).get("uri", ""))
+    return web.Response(body=body, content_type=mime_type, headers={
+        "Content-Disposition": content_disposition(uri, f"content-{index}")
+    })
+
+
+STATUS_LABELS = {"running": "运行中", "starting": "启动中", "ephemeral": "按需启动"}
+
+
+def render_service_card(svc: dict) -> str:
+    """服务端渲染单个服务卡片（与 app.js 的 renderServices 结构一致）"""
+    # 名称作为 JS 字符串字面量嵌入 onclick 属性
+    name = html.escape(json.dumps(svc["name"]), quote=True)
+    status = html.escape(svc["status"], quote=True)
+    if svc["status"] in ("running", "starting"):
+        toggle = (f'<button onclick="stopService({name})" class="btn btn-danger">'
+                  f'<i class="fas fa-stop"></i> 停止</button>')
+    else:
+        toggle = (f'<button onclick="startService({name})" class="btn btn-success">'
+                  f'<i class="fas fa-play"></i> 启动</button>')
+    return f"""
+        <div class="service-card">
+            <div class="header">
+                <h3>{html.escape(svc["displayName"])}</h3>
+                <span class="status-badge status-{status}">{STATUS_LABELS.get(svc["status"], "已停止")}</span>
+            </div>
+            <p>{html.escape(svc["description"])}</p>
+            <div class="actions">
+                {toggle}
+                <button onclick="callTool({name})" class="btn btn-primary">
+                    <i class="fas fa-terminal"></i> 调用
+                </button>
+            </div>
+        </div>"""
 
 
 async def web_ui(request):
-    return web.FileResponse(os.path.join(BASE_DIR, "templates/index.html"))
+    """Web 界面：服务端先渲染服务列表，再由 app.js 接管刷新"""
+    with open(os.path.join(BASE_DIR, "templates/index.html"), encoding="utf-8") as f:
+        page = f.read()
+    
+    services = service_summaries()
+    page = page.replace("{{ poll_interval }}", str(int(manager.web.poll_interval * 1000)))
+    page = page.replace("{{ base_path }}", html.escape(manager.server.base_path))
+    page = page.replace("{{ total }}", str(len(services)))
+    page = page.replace("{{ services }}", "".join(render_service_card(s) for s in services))
+    return web.Response(text=page, content_type="text/html")
 
 
 # ==================== 启动 ====================
 
+def reload_config() -> None:
+    """SIGHUP 处理：重载配置；新配置无效时记录原因并保留当前配置"""
+    try:
+        manager.load_config(CONFIG_PATH)
+    except Exception as e:
+        log(f"Config reload rejected: {e}")
+
+
 async def init(app):
     """初始化"""
-    manager.load_config(CONFIG_PATH)
+    manager.check_runtimes()
+    print("Startup diagnostics:")
+    print(json.dumps(manager.diagnostics(), indent=2, ensure_ascii=False))
     await manager.auto_start()  # 自动启动所有服务
+    app["health_task"] = asyncio.create_task(manager.health_loop())
+    app["recycle_task"] = asyncio.create_task(manager.recycle_loop())
+    
+    # SIGHUP 时热重载配置
+    try:
+        asyncio.get_running_loop().add_signal_handler(
+            signal.SIGHUP, reload_config)
+    except (NotImplementedError, AttributeError):
+        pass
 
 
-app = web.Application()
+async def cleanup(app):
+    """清理"""
+    for key in ("health_task", "recycle_task"):
+        task = app.get(key)
+        if task:
+            task.cancel()
+    await manager.stop_all()
+    await manager.close_http()
+
+
+# 应用在加载配置前创建：client_max_size 为硬上限（也覆盖无 Content-Length 的分块请求），
+# server.maxBodySize 在 limits_middleware 中按 Content-Length 校验（multipart 在读取时累计校验）
+MAX_BODY_SIZE_LIMIT = 64 * 1024 * 1024
+
+app = web.Application(middlewares=[request_id_middleware, pretty_middleware, cors_middleware, limits_middleware, auth_middleware],
+                      client_max_size=MAX_BODY_SIZE_LIMIT)
 app.on_startup.append(init)
-app.on_cleanup.append(manager.stop_all)
+app.on_cleanup.append(cleanup)
 
 # 路由
 app.router.add_get('/health', health)
+app.router.add_get('/api/v1/health/summary', health_summary)
 app.router.add_get('/api/v1/services', list_services)
+app.router.add_post('/api/v1/tools/call', fan_out_call)
+app.router.add_post('/api/v1/services/start-all', start_services)
+app.router.add_post('/api/v1/services/stop-all', stop_services)
+app.router.add_post('/api/v1/skills/export', export_skills)
+app.router.add_get('/api/v1/events', events)
+app.router.add_get('/api/v1/system/diagnostics', get_diagnostics)
+app.router.add_get('/api/v1/metrics', get_metrics)
 app.router.add_get('/api/v1/services/{name}', get_service)
+app.router.add_get('/api/v1/services/{name}/tools/{tool}/schema', get_tool_schema)
+app.router.add_get('/api/v1/services/{name}/ping', ping_service)
+app.router.add_get('/api/v1/services/{name}/logs', get_logs)
+app.router.add_get('/api/v1/services/{name}/initialize', get_initialize)
+app.router.add_get('/api/v1/services/{name}/history', get_history)
+app.router.add_get('/api/v1/services/{name}/skill', get_skill)
+app.router.add_post('/api/v1/services/{name}/skill/export', export_skill)
+app.router.add_get('/api/v1/services/{name}/resources', list_resources)
+app.router.add_get('/api/v1/services/{name}/resources/read', read_resource)
+app.router.add_get('/api/v1/services/{name}/prompts', list_prompts)
+app.router.add_get('/api/v1/services/{name}/client-config', get_client_config)
 app.router.add_post('/api/v1/services/{name}/start', start_service)
 app.router.add_post('/api/v1/services/{name}/stop', stop_service)
+app.router.add_post('/api/v1/services/{name}/complete', complete)
 app.router.add_post('/api/v1/services/{name}/call', call_tool)
+app.router.add_get('/api/v1/services/{name}/call/{request_id}/content/{index}', get_call_content)
 app.router.add_get('/', web_ui)
 
 # 静态文件
 app.router.add_get('/static/{path:.*}', lambda r: web.FileResponse(os.path.join(BASE_DIR, "static", r.match_info['path'])))
 
 
+STARTER_CONFIG = """# ClawMCP Gateway 配置（由 --init 生成，完整说明见 README）
+
+server:
+  # 监听地址：默认仅本机；对外暴露需显式设置为 0.0.0.0 并配置 apiKeys
+  host: 127.0.0.1
+  shutdownTimeout: 30s
+
+mcp:
+  enabled:
+    # 示例服务：按需修改 command/args，密钥通过 valueFrom 从环境变量读取
+    - name: filesystem
+      displayName: "文件系统"
+      description: "读写指定目录下的文件"
+      command: "npx"
+      args: ["-y", "@modelcontextprotocol/server-filesystem", "/tmp"]
+      enabled: true
+
+    # - name: github
+    #   command: "npx"
+    #   args: ["-y", "@modelcontextprotocol/server-github"]
+    #   env:
+    #     - name: GITHUB_PERSONAL_ACCESS_TOKEN
+    #       valueFrom: env:GITHUB_TOKEN
+"""
+
+
+def init_config(path: str) -> int:
+    """生成初始配置文件（已存在时不覆盖）"""
+    if os.path.exists(path):
+        print(f"Config already exists: {path}")
+        return 1
+    os.makedirs(os.path.dirname(os.path.abspath(path)), exist_ok=True)
+    with open(path, "w") as f:
+        f.write(STARTER_CONFIG)
+    print(f"Wrote starter config to {path}")
+    print("Edit the example service, then start the gateway with: python3 gateway.py")
+    return 0
+
+
+async def run_self_test(service: str) -> int:
+    """逐个验证服务能否完成握手并列出工具；有失败时返回非零"""
+    names = [n for n, svc in manager.config.items() if not svc.alias_of]
+    if service:
+        if service not in manager.config:
+            print(f"Service {service} not found")
+            return 1
+        names = [manager._runtime(service)]
+    
+    failed = 0
+    for name in names:
+        result = await manager.self_test(name)
+        if result["ok"]:
+            print(f"PASS {name} ({result['seconds']}s, {result['tools']} tools)")
+            continue
+        failed += 1
+        print(f"FAIL {name} ({result['seconds']}s): {result['error']}")
+        for line in result["stderr"]:
+            print(f"    {line}")
+    print(f"{len(names) - failed}/{len(names)} services passed")
+    return 1 if failed else 0
+
+
 if __name__ == "__main__":
-    print(f"Starting ClawMCP Gateway on http://{INTERNAL_HOST}:{PORT}")
-    web.run_app(app, host=INTERNAL_HOST, port=PORT, access_log=False)
+    parser = argparse.ArgumentParser(description="ClawMCP Gateway")
+    parser.add_argument("--init", action="store_true", help="生成初始配置文件后退出")
+    parser.add_argument("--test", action="store_true",
+                        help="依次启动每个服务并执行 initialize + tools/list，有失败时以非零退出")
+    parser.add_argument("--service", default="", help="与 --test 一起使用：只测试指定服务")
+    args = parser.parse_args()
+    
+    if args.init:
+        sys.exit(init_config(CONFIG_PATH))
+    if not os.path.exists(CONFIG_PATH):
+        print(f"Config not found: {CONFIG_PATH}")
+        print("Run 'python3 gateway.py --init' to create a starter config, "
+              "or set CLAWMCP_CONFIG to an existing file.")
+        sys.exit(1)
+    manager.load_config(CONFIG_PATH)
+    if args.test:
+        sys.exit(asyncio.run(run_self_test(args.service)))
+    host = manager.server.host
+    if not is_loopback(host) and not manager.server.api_keys:
+        if manager.server.require_auth_for_public_bind:
+            print(f"Refusing to bind to {host} without authentication: "
+                  f"configure server.apiKeys or bind to 127.0.0.1")
+            sys.exit(1)
+        print("=" * 60)
+        print(f"WARNING: binding to non-loopback address {host} without authentication.")
+        print("Anyone who can reach this port can start processes and call tools.")
+        print("Configure server.apiKeys, or set server.requireAuthForPublicBind: true to refuse this.")
+        print("=" * 60)
+    base_path = manager.server.base_path
+    root = app
+    if base_path:
+        # 反向代理子路径：全部路由挂载到 basePath 下（修改 basePath 需重启生效）
+        root = web.Application(client_max_size=MAX_BODY_SIZE_LIMIT)
+        root.add_subapp(base_path, app)
+    print(f"Starting ClawMCP Gateway on http://{host}:{PORT}{base_path}/")
+    web.run_app(root, host=host, port=PORT, access_log=False,
+                shutdown_timeout=manager.server.shutdown_timeout,
+                keepalive_timeout=manager.server.keep_alive_timeout)
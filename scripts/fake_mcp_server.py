@@ -0,0 +1,218 @@
+#!/usr/bin/env python3
+"""
+Fake MCP Server - 用于本地调试网关的 stdio MCP 服务
+支持 initialize / tools/list / tools/call / ping，行为可通过工具参数和环境变量控制：
+
+  FAKE_INIT_DELAY    initialize 响应前的延迟（秒）
+  FAKE_PAGE_SIZE     tools/list 分页大小（0 为不分页）
+  FAKE_FRAMING       newline（默认）或 contentLength
+  FAKE_STDOUT_NOISE  启动时向 stdout 输出一行非 JSON 文本（验证网关的容错）
+"""
+import os
+import sys
+import json
+import time
+import threading
+
+
+# ==================== 配置 ====================
+
+INIT_DELAY = float(os.getenv("FAKE_INIT_DELAY", "0"))
+PAGE_SIZE = int(os.getenv("FAKE_PAGE_SIZE", "0"))
+FRAMING = os.getenv("FAKE_FRAMING", "newline")
+
+TOOLS = [
+    {
+        "name": "echo",
+        "description": "原样返回参数",
+        "inputSchema": {"type": "object", "properties": {"text": {"type": "string"}}, "required": ["text"]},
+        "annotations": {"readOnlyHint": True},
+    },
+    {
+        "name": "sleep",
+        "description": "延迟 seconds 秒后返回（在后台线程中等待，可并发）",
+        "inputSchema": {"type": "object", "properties": {"seconds": {"type": "number"}}},
+        "annotations": {"readOnlyHint": True},
+    },
+    {
+        "name": "fail",
+        "description": "mode=rpc 返回 JSON-RPC 错误，mode=tool 返回 isError 结果，mode=exit 直接退出进程",
+        "inputSchema": {"type": "object", "properties": {"mode": {"type": "string", "enum": ["rpc", "tool", "exit"]}}},
+    },
+    {
+        "name": "large",
+        "description": "返回 size 字节的文本",
+        "inputSchema": {"type": "object", "properties": {"size": {"type": "integer"}}},
+        "annotations": {"readOnlyHint": True},
+    },
+    {
+        "name": "notify",
+        "description": "先发送 count 条 notifications/message 再返回",
+        "inputSchema": {"type": "object", "properties": {"count": {"type": "integer"}}},
+    },
+    {
+        "name": "process",
+        "description": "返回进程的启动参数（argv）与环境变量",
+        "inputSchema": {"type": "object", "properties": {}},
+        "annotations": {"readOnlyHint": True},
+    },
+    {
+        "name": "malformed",
+        "description": "返回含末尾逗号和 NaN 的不合规 JSON（验证 lenientJson）",
+        "inputSchema": {"type": "object", "properties": {}},
+        "annotations": {"readOnlyHint": True},
+    },
+    {
+        "name": "toggle_tool",
+        "description": "添加/移除 extra 工具并发送 notifications/tools/list_changed",
+        "inputSchema": {"type": "object", "properties": {}},
+    },
+]
+
+EXTRA_TOOL = {
+    "name": "extra",
+    "description": "由 toggle_tool 动态添加的工具",
+    "inputSchema": {"type": "object", "properties": {}},
+}
+
+
+# ==================== 传输 ====================
+
+write_lock = threading.Lock()
+
+
+def send(message, raw: bool = False) -> None:
+    """写出一条消息（多线程安全）；raw 时 message 为原样写出的文本"""
+    data = (message if raw else json.dumps(message, ensure_ascii=False)).encode()
+    with write_lock:
+        if FRAMING == "contentLength":
+            sys.stdout.buffer.write(f"Content-Length: {len(data)}\r\n\r\n".encode() + data)
+        else:
+            sys.stdout.buffer.write(data + b"\n")
+        sys.stdout.buffer.flush()
+
+
+def read_messages():
+    """按配置的分帧方式逐条读取消息"""
+    stdin = sys.stdin.buffer
+    while True:
+        if FRAMING == "contentLength":
+            length = None
+            while True:
+                line = stdin.readline()
+                if not line:
+                    return
+                line = line.strip()
+                if not line:
+                    break
+                key, _, value = line.decode().partition(":")
+                if key.lower() == "content-length":
+                    length = int(value)
+            if length is None:
+                continue
+            body = stdin.read(length)
+        else:
+            body = stdin.readline()
+            if not body:
+                return
+        try:
+            yield json.loads(body)
+        except ValueError:
+            print(f"invalid message: {body[:200]!r}", file=sys.stderr)
+
+
+def result(req_id, value: dict) -> None:
+    send({"jsonrpc": "2.0", "id": req_id, "result": value})
+
+
+def error(req_id, code: int, message: str) -> None:
+    send({"jsonrpc": "2.0", "id": req_id, "error": {"code": code, "message": message}})
+
+
+def text(value: str) -> dict:
+    return {"content": [{"type": "text", "text": value}]}
+
+
+# ==================== 处理 ====================
+
+def call_tool(req_id, name: str, args: dict) -> None:
+    if name == "echo":
+        result(req_id, text(json.dumps(args, ensure_ascii=False)))
+    elif name == "sleep":
+        def later():
+            time.sleep(float(args.get("seconds", 1)))
+            result(req_id, text("slept"))
+        threading.Thread(target=later, daemon=True).start()
+    elif name == "fail":
+        mode = args.get("mode", "rpc")
+        if mode == "exit":
+            print("exiting on request", file=sys.stderr)
+            os._exit(1)
+        if mode == "tool":
+            result(req_id, {**text("tool failed"), "isError": True})
+        else:
+            error(req_id, -32000, "fake failure")
+    elif name == "large":
+        result(req_id, text("x" * int(args.get("size", 1024 * 1024))))
+    elif name == "notify":
+        for i in range(int(args.get("count", 1))):
+            send({"jsonrpc": "2.0", "method": "notifications/message",
+                  "params": {"level": "info", "data": f"progress {i + 1}"}})
+        result(req_id, text("notified"))
+    elif name == "process":
+        result(req_id, text(json.dumps({"argv": sys.argv[1:], "env": dict(os.environ)})))
+    elif name == "malformed":
+        send('{"jsonrpc": "2.0", "id": %s, "result": {"content": [{"type": "text", "text": "a, ]"},], '
+             '"structuredContent": {"score": NaN, "max": Infinity,},},}' % json.dumps(req_id), raw=True)
+    elif name == "toggle_tool":
+        if EXTRA_TOOL in TOOLS:
+            TOOLS.remove(EXTRA_TOOL)
+        else:
+            TOOLS.append(EXTRA_TOOL)
+        result(req_id, text("extra " + ("added" if EXTRA_TOOL in TOOLS else "removed")))
+        send({"jsonrpc": "2.0", "method": "notifications/tools/list_changed"})
+    elif name == "extra" and EXTRA_TOOL in TOOLS:
+        result(req_id, text("extra"))
+    else:
+        error(req_id, -32602, f"Unknown tool: {name}")
+
+
+def handle(message: dict) -> None:
+    method = message.get("method")
+    req_id = message.get("id")
+    params = message.get("params") or {}
+
+    if method == "initialize":
+        time.sleep(INIT_DELAY)
+        result(req_id, {
+            "protocolVersion": params.get("protocolVersion", "2024-11-05"),
+            "capabilities": {"tools": {"listChanged": True}},
+            "serverInfo": {"name": "fake-mcp-server", "version": "1.0"},
+        })
+    elif method == "tools/list":
+        if PAGE_SIZE > 0:
+            start = int(params.get("cursor") or 0)
+            page = {"tools": TOOLS[start:start + PAGE_SIZE]}
+            if start + PAGE_SIZE < len(TOOLS):
+                page["nextCursor"] = str(start + PAGE_SIZE)
+            result(req_id, page)
+        else:
+            result(req_id, {"tools": TOOLS})
+    elif method == "tools/call":
+        call_tool(req_id, params.get("name", ""), params.get("arguments") or {})
+    elif method == "ping":
+        result(req_id, {})
+    elif req_id is not None and method:
+        error(req_id, -32601, f"Method not found: {method}")
+
+
+def main() -> None:
+    if os.getenv("FAKE_STDOUT_NOISE"):
+        print("fake-mcp-server starting", flush=True)
+    print("fake-mcp-server ready", file=sys.stderr, flush=True)
+    for message in read_messages():
+        handle(message)
+
+
+if __name__ == "__main__":
+    main()
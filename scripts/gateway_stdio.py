@@ -0,0 +1,130 @@
+#!/usr/bin/env python3
+"""
+Gateway stdio client - 把网关中的一个服务以 stdio MCP 服务的形式提供给桌面客户端
+tools/list 与 tools/call 转发到网关的 HTTP 接口，因此认证、工具过滤、只读模式、默认参数和调用记录都照常生效。
+只依赖标准库，可复制到客户端所在机器单独使用：
+
+  python3 gateway_stdio.py --url http://127.0.0.1:8080 --service minimax-search
+
+  CLAWMCP_API_KEY  网关配置了 server.apiKeys 时使用的 API Key
+"""
+import os
+import sys
+import json
+import argparse
+import threading
+import urllib.error
+import urllib.parse
+import urllib.request
+
+
+# ==================== 网关 ====================
+
+class Gateway:
+    def __init__(self, url: str, service: str, api_key: str, timeout: float):
+        self.base = f"{url.rstrip('/')}/api/v1/services/{urllib.parse.quote(service, safe='')}"
+        self.api_key = api_key
+        self.timeout = timeout
+
+    def request(self, path: str, body: dict = None) -> dict:
+        """请求网关接口；HTTP 错误时抛出带错误信息的 RuntimeError"""
+        headers = {"Content-Type": "application/json"}
+        if self.api_key:
+            headers["X-API-Key"] = self.api_key
+        data = json.dumps(body).encode() if body is not None else None
+        req = urllib.request.Request(self.base + path, data=data, headers=headers,
+                                     method="POST" if data is not None else "GET")
+        try:
+            with urllib.request.urlopen(req, timeout=self.timeout) as resp:
+                return json.loads(resp.read())
+        except urllib.error.HTTPError as e:
+            text = e.read().decode(errors="replace")
+            try:
+                text = json.loads(text).get("message") or text
+            except (ValueError, AttributeError):
+                pass
+            raise RuntimeError(f"gateway returned HTTP {e.code}: {text}")
+        except (urllib.error.URLError, OSError) as e:
+            raise RuntimeError(f"gateway unreachable: {getattr(e, 'reason', e)}")
+
+    def list_tools(self) -> list:
+        return self.request("").get("tools") or []
+
+    def call_tool(self, name: str, arguments: dict) -> dict:
+        return self.request("/call?resultMode=raw", {"tool": name, "arguments": arguments}).get("result") or {}
+
+
+# ==================== 传输 ====================
+
+write_lock = threading.Lock()
+
+
+def send(message: dict) -> None:
+    """写出一条消息（多线程安全）"""
+    with write_lock:
+        sys.stdout.write(json.dumps(message, ensure_ascii=False) + "\n")
+        sys.stdout.flush()
+
+
+def result(req_id, value: dict) -> None:
+    send({"jsonrpc": "2.0", "id": req_id, "result": value})
+
+
+def error(req_id, code: int, message: str) -> None:
+    send({"jsonrpc": "2.0", "id": req_id, "error": {"code": code, "message": message}})
+
+
+# ==================== 处理 ====================
+
+def handle(gateway: Gateway, service: str, message: dict) -> None:
+    method = message.get("method")
+    req_id = message.get("id")
+    params = message.get("params") or {}
+
+    if method == "initialize":
+        result(req_id, {
+            "protocolVersion": params.get("protocolVersion", "2024-11-05"),
+            "capabilities": {"tools": {}},
+            "serverInfo": {"name": f"clawmcp-gateway/{service}", "version": "1.0"},
+        })
+    elif method == "tools/list":
+        try:
+            result(req_id, {"tools": gateway.list_tools()})
+        except RuntimeError as e:
+            error(req_id, -32603, str(e))
+    elif method == "tools/call":
+        # 在线程中调用，长时间运行的工具不阻塞其他请求
+        def call():
+            try:
+                result(req_id, gateway.call_tool(params.get("name", ""), params.get("arguments") or {}))
+            except RuntimeError as e:
+                result(req_id, {"content": [{"type": "text", "text": str(e)}], "isError": True})
+        threading.Thread(target=call, daemon=True).start()
+    elif method == "ping":
+        result(req_id, {})
+    elif req_id is not None and method:
+        error(req_id, -32601, f"Method not found: {method}")
+
+
+def main() -> None:
+    parser = argparse.ArgumentParser(description="Expose a ClawMCP Gateway service as a stdio MCP server")
+    parser.add_argument("--url", required=True, help="网关地址（含 server.basePath），如 http://127.0.0.1:8080")
+    parser.add_argument("--service", required=True, help="服务名")
+    parser.add_argument("--timeout", type=float, default=330, help="单次请求超时（秒）")
+    args = parser.parse_args()
+
+    gateway = Gateway(args.url, args.service, os.getenv("CLAWMCP_API_KEY", ""), args.timeout)
+    for line in sys.stdin:
+        if not line.strip():
+            continue
+        try:
+            message = json.loads(line)
+        except ValueError:
+            print(f"invalid message: {line[:200]!r}", file=sys.stderr)
+            continue
+        if isinstance(message, dict):
+            handle(gateway, args.service, message)
+
+
+if __name__ == "__main__":
+    main()
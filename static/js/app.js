@@ -1,6 +1,8 @@
 // ClawMCP Gateway Frontend
 
-const API_BASE = '/api/v1';
+// server.basePath when served behind a reverse proxy sub-path
+const BASE_PATH = document.body.dataset.basePath || '';
+const API_BASE = `${BASE_PATH}/api/v1`;
 
 // Console functions
 function log(message, type = 'log') {
@@ -27,50 +29,67 @@ async function loadServices() {
         const resp = await fetch(`${API_BASE}/services`);
         const data = await resp.json();
         
-        if (data.success) {
-            document.getElementById('totalCount').textContent = data.data.length;
-            renderServices(data.data);
-            logInfo(`已加载 ${data.data.length} 个服务`);
+        if (resp.ok) {
+            const services = data.services || [];
+            document.getElementById('totalCount').textContent = services.length;
+            renderServices(services);
+            logInfo(`已加载 ${services.length} 个服务`);
+        } else {
+            logError(`加载失败: HTTP ${resp.status}`);
         }
     } catch (e) {
         logError(`加载失败: ${e.message}`);
     }
 }
 
+// Escape untrusted values (service/tool metadata) before inserting into HTML
+function escapeHtml(value) {
+    return String(value ?? '')
+        .replace(/&/g, '&amp;')
+        .replace(/</g, '&lt;')
+        .replace(/>/g, '&gt;')
+        .replace(/"/g, '&quot;')
+        .replace(/'/g, '&#39;');
+}
+
 // Render services
 function renderServices(services) {
     const container = document.getElementById('services');
-    container.innerHTML = services.map(svc => `
+    container.innerHTML = services.map(svc => {
+        // name is embedded as a JS string literal inside an onclick attribute
+        const name = escapeHtml(JSON.stringify(svc.name));
+        return `
         <div class="service-card">
             <div class="header">
-                <h3>${svc.displayName}</h3>
-                <span class="status-badge status-${svc.status}">
-                    ${svc.status === 'running' ? '运行中' : '已停止'}
+                <h3>${escapeHtml(svc.displayName)}</h3>
+                <span class="status-badge status-${escapeHtml(svc.status)}">
+                    ${svc.status === 'running' ? '运行中' : svc.status === 'starting' ? '启动中' : '已停止'}
                 </span>
             </div>
-            <p>${svc.description}</p>
+            <p>${escapeHtml(svc.description)}</p>
             <div class="actions">
-                ${svc.status === 'running' 
-                    ? `<button onclick="stopService('${svc.name}')" class="btn btn-danger">
+                ${svc.status === 'running' || svc.status === 'starting'
+                    ? `<button onclick="stopService(${name})" class="btn btn-danger">
                         <i class="fas fa-stop"></i> 停止
                        </button>`
-                    : `<button onclick="startService('${svc.name}')" class="btn btn-success">
+                    : `<button onclick="startService(${name})" class="btn btn-success">
                         <i class="fas fa-play"></i> 启动
                        </button>`
                 }
-                <button onclick="callTool('${svc.name}')" class="btn btn-primary">
+                <button onclick="callTool(${name})" class="btn btn-primary">
                     <i class="fas fa-terminal"></i> 调用
                 </button>
             </div>
         </div>
-    `).join('');
+    `;
+    }).join('');
 }
 
 // Start service
 async function startService(name) {
     try {
         logInfo(`启动服务: ${name}...`);
-        const resp = await fetch(`${API_BASE}/services/${name}/start`, { 
+        const resp = await fetch(`${API_BASE}/services/${encodeURIComponent(name)}/start`, { 
             method: 'POST' 
         });
         const data = await resp.json();
@@ -90,7 +109,7 @@ async function startService(name) {
 async function stopService(name) {
     try {
         logInfo(`停止服务: ${name}...`);
-        const resp = await fetch(`${API_BASE}/services/${name}/stop`, { 
+        const resp = await fetch(`${API_BASE}/services/${encodeURIComponent(name)}/stop`, { 
             method: 'POST' 
         });
         const data = await resp.json();
@@ -114,11 +133,25 @@ async function callTool(name) {
     const argsStr = prompt('请输入参数 (JSON格式):', '{"query":"测试"}');
     if (!argsStr) return;
     
+    // Warn before calling tools the server explicitly annotates as destructive
+    try {
+        const schemaResp = await fetch(`${API_BASE}/services/${encodeURIComponent(name)}/tools/${encodeURIComponent(tool)}/schema`);
+        if (schemaResp.ok) {
+            const schema = await schemaResp.json();
+            if (schema.annotations && schema.annotations.destructiveHint &&
+                !confirm(`${tool} 可能修改或删除数据，确认调用？`)) {
+                return;
+            }
+        }
+    } catch (e) {
+        // Schema lookup is best-effort; fall through to the call
+    }
+    
     try {
         const args = JSON.parse(argsStr);
         logInfo(`调用 ${name}.${tool}...`);
         
-        const resp = await fetch(`${API_BASE}/services/${name}/call`, {
+        const resp = await fetch(`${API_BASE}/services/${encodeURIComponent(name)}/call`, {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify({ tool, arguments: args })
@@ -140,7 +173,7 @@ async function callTool(name) {
 // Health check
 async function checkHealth() {
     try {
-        const resp = await fetch('/health');
+        const resp = await fetch(`${BASE_PATH}/health`);
         const data = await resp.json();
         logInfo(`Gateway 状态: ${data.status}`);
     } catch (e) {
@@ -148,10 +181,69 @@ async function checkHealth() {
     }
 }
 
+// Auto refresh: live updates over SSE, polling (web.pollInterval) as fallback
+const SERVICE_EVENTS = ['starting', 'started', 'stopped', 'exited', 'restarted', 'healthy', 'unhealthy', 'tools_changed'];
+let pollTimer = null;
+let paused = false;
+let eventSource = null;
+
+function pollInterval() {
+    const ms = parseInt(document.body.dataset.pollInterval, 10);
+    return Number.isFinite(ms) && ms > 0 ? ms : 30000;
+}
+
+function startPolling() {
+    stopPolling();
+    pollTimer = setInterval(loadServices, pollInterval());
+}
+
+function stopPolling() {
+    if (pollTimer) {
+        clearInterval(pollTimer);
+        pollTimer = null;
+    }
+}
+
+function connectEvents() {
+    if (!window.EventSource) return;
+    eventSource = new EventSource(`${API_BASE}/events`);
+    eventSource.onopen = () => {
+        stopPolling();
+        logInfo('已连接实时事件推送');
+    };
+    eventSource.onerror = () => {
+        // EventSource reconnects by itself; poll meanwhile
+        if (!paused && !pollTimer) startPolling();
+    };
+    SERVICE_EVENTS.forEach(type => {
+        eventSource.addEventListener(type, e => {
+            if (paused) return;
+            const data = JSON.parse(e.data);
+            logInfo(`服务 ${data.service}: ${type}`);
+            loadServices();
+        });
+    });
+}
+
+function togglePolling() {
+    const btn = document.getElementById('pollToggle');
+    paused = !paused;
+    if (paused) {
+        stopPolling();
+        btn.innerHTML = '<i class="fas fa-play"></i> 恢复刷新';
+        logInfo('已暂停自动刷新');
+    } else {
+        if (!eventSource || eventSource.readyState !== EventSource.OPEN) startPolling();
+        loadServices();
+        btn.innerHTML = '<i class="fas fa-pause"></i> 暂停刷新';
+        logInfo('已恢复自动刷新');
+    }
+}
+
 // Initialize
 document.addEventListener('DOMContentLoaded', () => {
     loadServices();
     checkHealth();
-    // Auto refresh every 30s
-    setInterval(loadServices, 30000);
+    startPolling();
+    connectEvents();
 });
@@ -0,0 +1,606 @@
+"""
+网关集成测试：以 scripts/fake_mcp_server.py 作为 MCP 服务驱动 MCPManager
+
+运行（在仓库根目录，需已安装 aiohttp 与 pyyaml）：python3 -m unittest discover tests
+"""
+import os
+import sys
+import json
+import time
+import asyncio
+import tempfile
+import unittest
+from types import SimpleNamespace
+from unittest import mock
+
+import yaml
+from aiohttp import web
+
+ROOT = os.path.dirname(os.path.dirname(os.path.abspath(__file__)))
+sys.path.insert(0, ROOT)
+
+import gateway  # noqa: E402
+
+FAKE_SERVER = os.path.join(ROOT, "scripts", "fake_mcp_server.py")
+
+
+def fake_service(name: str, **extra) -> dict:
+    """以 fake server 为命令的服务配置"""
+    return {"name": name, "command": sys.executable, "args": [FAKE_SERVER], **extra}
+
+
+def error_code(exc: web.HTTPException) -> str:
+    return json.loads(exc.text)["errorCode"]
+
+
+def result_json(result: dict) -> dict:
+    """fake server 以 JSON 文本返回的工具结果"""
+    return json.loads(result["content"][0]["text"])
+
+
+class GatewayTestCase(unittest.IsolatedAsyncioTestCase):
+    """每个用例使用独立的 MCPManager 与临时配置文件，结束时停止所有进程"""
+
+    def setUp(self):
+        self.tmp = tempfile.TemporaryDirectory()
+        self.manager = None
+
+    async def asyncTearDown(self):
+        if self.manager is not None:
+            await self.manager.stop_all()
+
+    def tearDown(self):
+        self.tmp.cleanup()
+
+    def write_config(self, services: list, **top) -> str:
+        path = os.path.join(self.tmp.name, "config.yaml")
+        with open(path, "w") as f:
+            yaml.safe_dump({**top, "mcp": {"enabled": services}}, f)
+        return path
+
+    def load(self, services: list, **top) -> gateway.MCPManager:
+        self.manager = gateway.MCPManager()
+        self.manager.load_config(self.write_config(services, **top))
+        return self.manager
+
+
+class ServiceNameTest(GatewayTestCase):
+    """服务名规范化与重名检测"""
+
+    def test_names_are_normalized(self):
+        manager = self.load([fake_service("  Fake-Search "), fake_service("other_1")])
+        self.assertEqual(sorted(manager.config), ["fake-search", "other_1"])
+
+    def test_collision_after_normalization_is_rejected(self):
+        with self.assertRaisesRegex(ValueError, "duplicate service name"):
+            self.load([fake_service("Fake"), fake_service(" fake ")])
+
+    def test_invalid_name_is_rejected(self):
+        with self.assertRaises(ValueError):
+            self.load([fake_service("bad/name")])
+
+
+class ReloadTest(GatewayTestCase):
+    """热重载：新配置有错误时保留当前配置"""
+
+    def test_invalid_reload_keeps_current_config(self):
+        manager = self.load([fake_service("a"), fake_service("b")], server={"historySize": 10})
+        path = self.write_config([fake_service("a"), fake_service("b", framing="bogus"), fake_service("c")],
+                                 server={"historySize": 99})
+        with self.assertRaisesRegex(ValueError, "framing"):
+            manager.load_config(path)
+        self.assertEqual(sorted(manager.config), ["a", "b"])
+        self.assertEqual(manager.server.history_size, 10)
+
+    def test_signal_reload_logs_and_keeps_config(self):
+        manager = self.load([fake_service("a")])
+        path = self.write_config([fake_service("a", framing="bogus")])
+        with mock.patch.object(gateway, "manager", manager), mock.patch.object(gateway, "CONFIG_PATH", path), \
+                mock.patch.object(gateway, "log") as log:
+            gateway.reload_config()
+        self.assertIn("reload rejected", log.call_args[0][0])
+        self.assertEqual(manager.config["a"].framing, gateway.FRAMING_NEWLINE)
+
+
+class CallTest(GatewayTestCase):
+    """调用：响应关联、超时、大结果"""
+
+    async def test_concurrent_calls_get_their_own_results(self):
+        manager = self.load([fake_service("fake")])
+        await manager.start_service("fake")
+        texts = [f"call-{i}" for i in range(20)]
+        results = await asyncio.gather(*(manager.call_tool("fake", "echo", {"text": t}) for t in texts))
+        self.assertEqual([result_json(r)["text"] for r in results], texts)
+
+    async def test_slow_call_times_out(self):
+        manager = self.load([fake_service("fake", timeout="1s")])
+        await manager.start_service("fake")
+        with self.assertRaises(web.HTTPGatewayTimeout) as ctx:
+            await manager.call_tool("fake", "sleep", {"seconds": 5})
+        self.assertEqual(error_code(ctx.exception), "CALL_TIMEOUT")
+
+    async def test_large_result_is_not_truncated(self):
+        manager = self.load([fake_service("fake")])
+        await manager.start_service("fake")
+        result = await manager.call_tool("fake", "large", {"size": 4 * 1024 * 1024})
+        self.assertEqual(len(result["content"][0]["text"]), 4 * 1024 * 1024)
+
+    async def test_unknown_tool(self):
+        manager = self.load([fake_service("fake")])
+        await manager.start_service("fake")
+        with self.assertRaises(web.HTTPNotFound) as ctx:
+            await manager.call_tool("fake", "missing", {})
+        self.assertEqual(error_code(ctx.exception), "TOOL_NOT_FOUND")
+
+    async def test_first_call_is_validated(self):
+        manager = self.load([fake_service("fake")])
+        await manager.start_service("fake")
+        # 工具列表尚未缓存：先拉取再按 schema 校验
+        with self.assertRaises(web.HTTPBadRequest):
+            await manager.call_tool("fake", "echo", {"text": 1})
+
+    async def test_call_to_exited_process_is_not_running(self):
+        manager = self.load([fake_service("fake")])
+        await manager.start_service("fake")
+        running = manager.running["fake"]
+        with self.assertRaises(web.HTTPInternalServerError):
+            await manager.call_tool("fake", "fail", {"mode": "exit"})
+        await asyncio.to_thread(running.process.wait)
+        # 退出尚未被察觉：写入 stdin 时管道已断开
+        with mock.patch.object(running.process, "poll", return_value=None):
+            with self.assertRaises(web.HTTPBadGateway) as ctx:
+                await manager.call_tool("fake", "echo", {"text": "x"})
+        self.assertEqual(error_code(ctx.exception), "NOT_RUNNING")
+
+    async def test_read_only_uses_declared_hints(self):
+        manager = self.load([fake_service("fake")], server={"readOnly": True})
+        await manager.start_service("fake")
+        # 工具列表尚未缓存：readOnlyHint 的工具仍可调用
+        result = await manager.call_tool("fake", "echo", {"text": "hi"})
+        self.assertEqual(result_json(result)["text"], "hi")
+        with self.assertRaises(web.HTTPForbidden):
+            await manager.call_tool("fake", "notify", {"count": 1})
+
+    async def test_caller_template_does_not_expose_api_key(self):
+        manager = self.load([fake_service("fake", tools=[
+            {"name": "echo", "defaults": {"tenant": "{{.caller}}"}},
+        ])], server={"apiKeys": [{"name": "team-a", "value": "sekrit"}]})
+        await manager.start_service("fake")
+        result = await manager.call_tool("fake", "echo", {"text": "x"}, gateway.CallContext(api_key="sekrit"))
+        self.assertEqual(result_json(result), {"tenant": "team-a", "text": "x"})
+
+    def test_api_key_template_is_rejected(self):
+        with self.assertRaisesRegex(ValueError, r"\{\{\.caller\}\}"):
+            self.load([fake_service("fake", tools=[{"name": "echo", "defaults": {"tenant": "{{.apiKey}}"}}])])
+
+
+class WriteTest(GatewayTestCase):
+    """并发写入 stdin 时消息不交错"""
+
+    async def test_concurrent_writers_do_not_interleave(self):
+        manager = self.load([fake_service("fake")])
+        await manager.start_service("fake")
+        running = manager._pick("fake")
+
+        # 模拟管道的部分写入：每帧分成小块写出，没有写锁时不同消息的分块会交错
+        def write_in_chunks(stdin, frame):
+            for i in range(0, len(frame), 4096):
+                stdin.write(frame[i:i + 4096])
+                stdin.flush()
+                time.sleep(0)
+        manager._write_frame = write_in_chunks
+
+        notes = [manager._write(running, {"jsonrpc": "2.0", "method": "notifications/test",
+                                          "params": {"pad": str(i) * 200_000}})
+                 for i in range(10)]
+        calls = [manager.call_tool("fake", "echo", {"text": "x" * 100_000}) for _ in range(5)]
+        results = await asyncio.gather(*notes, *calls)
+        self.assertTrue(all(result_json(r)["text"] == "x" * 100_000 for r in results[10:]))
+        # fake server 对无法解析的输入会在 stderr 记录 invalid message
+        stderr = [line for _, line in running.stderr]
+        self.assertFalse([line for line in stderr if "invalid message" in line])
+
+
+class EnvTest(GatewayTestCase):
+    """子进程只看到预期的环境变量"""
+
+    async def test_child_sees_exactly_the_intended_env(self):
+        env_file = os.path.join(self.tmp.name, "svc.env")
+        with open(env_file, "w") as f:
+            f.write("FROM_FILE=file\nOVERRIDDEN=file\n")
+        os.environ["GATEWAY_ONLY_SECRET"] = "secret"
+        os.environ["FAKE_PASSED"] = "passed"
+        self.addCleanup(os.environ.pop, "GATEWAY_ONLY_SECRET", None)
+        self.addCleanup(os.environ.pop, "FAKE_PASSED", None)
+
+        manager = self.load([fake_service("fake", envFile=env_file, env=[
+            {"name": "LITERAL", "value": "literal"},
+            {"name": "OVERRIDDEN", "value": "env"},
+            {"name": "FROM_GATEWAY", "valueFrom": "env:FAKE_PASSED"},
+        ])])
+        await manager.start_service("fake")
+        env = result_json(await manager.call_tool("fake", "process", {}))["env"]
+        # Python 可能为 C/POSIX locale 自行设置 LC_CTYPE
+        env.pop("LC_CTYPE", None)
+
+        expected = {k: os.environ[k] for k in gateway.BASE_ENV_KEYS if k in os.environ}
+        expected.update(FROM_FILE="file", OVERRIDDEN="env", LITERAL="literal", FROM_GATEWAY="passed")
+        self.assertEqual(env, expected)
+
+    async def test_invalid_env_file_does_not_stop_secret_rotation(self):
+        env_file = os.path.join(self.tmp.name, "svc.env")
+        with open(env_file, "w") as f:
+            f.write("TOKEN=\"unterminated\n")
+        manager = self.load([fake_service("fake", envFile=env_file, env=[
+            {"name": "SECRET", "valueFrom": "env:FAKE_SECRET", "onChange": "recycle"},
+        ])])
+        self.assertFalse(await manager._rotate_secrets("fake", manager.config["fake"]))
+
+
+class EnvFileTest(unittest.TestCase):
+    """.env 解析：引号、转义、export 前缀与注释"""
+
+    def test_parse_env_value(self):
+        cases = {
+            "plain": "plain",
+            "  spaced  ": "spaced",
+            "value # comment": "value",
+            "a=b=c": "a=b=c",
+            '"with = and spaces"': "with = and spaces",
+            '"line\\nbreak \\"quoted\\" \\$HOME"': 'line\nbreak "quoted" $HOME',
+            '"hash # kept"': "hash # kept",
+            "'single \\n $literal'": "single \\n $literal",
+            '""': "",
+        }
+        for raw, expected in cases.items():
+            with self.subTest(raw=raw):
+                self.assertEqual(gateway.parse_env_value(raw), expected)
+
+    def test_unterminated_quote_is_rejected(self):
+        for raw in ('"open', "'open"):
+            with self.subTest(raw=raw), self.assertRaises(ValueError):
+                gateway.parse_env_value(raw)
+
+    def write(self, content: str) -> str:
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        path = os.path.join(tmp.name, ".env")
+        with open(path, "w") as f:
+            f.write(content)
+        return path
+
+    def test_load_env_file(self):
+        path = self.write(
+            "# comment\n"
+            "\n"
+            "export EXPORTED=1\n"
+            "SECRET=\"abc=def ghi\"\n"
+            "SINGLE='x y'\n"
+            "SPACED = value # trailing\n"
+            "not a variable\n"
+        )
+        self.assertEqual(gateway.load_env_file(path), {
+            "EXPORTED": "1", "SECRET": "abc=def ghi", "SINGLE": "x y", "SPACED": "value",
+        })
+
+    def test_errors_include_location(self):
+        with self.assertRaisesRegex(ValueError, r":2: invalid variable name"):
+            gateway.load_env_file(self.write("OK=1\n1BAD=x\n"))
+        with self.assertRaisesRegex(ValueError, r":1: TOKEN: unterminated"):
+            gateway.load_env_file(self.write("TOKEN=\"abc\n"))
+
+
+class OverrideTest(GatewayTestCase):
+    """参数化实例的启动参数覆盖"""
+
+    async def test_override_values_are_not_expanded(self):
+        os.environ["FAKE_CONFIGURED"] = "configured"
+        os.environ["GATEWAY_ONLY_SECRET"] = "secret"
+        self.addCleanup(os.environ.pop, "FAKE_CONFIGURED", None)
+        self.addCleanup(os.environ.pop, "GATEWAY_ONLY_SECRET", None)
+
+        manager = self.load([fake_service("fake", args=[FAKE_SERVER, "--mode", "${env:FAKE_CONFIGURED}"],
+                                          overridable={"args": ["--tenant"]})])
+        overrides = manager.validate_overrides("fake", {"args": {"--tenant": "${env:GATEWAY_ONLY_SECRET}"}})
+        result = await manager.call_tool("fake", "process", {}, gateway.CallContext(overrides=overrides))
+        self.assertEqual(result_json(result)["argv"],
+                         ["--mode", "configured", "--tenant", "${env:GATEWAY_ONLY_SECRET}"])
+
+    async def test_slow_instance_does_not_block_others(self):
+        manager = self.load([fake_service("fake", overridable={"env": ["FAKE_INIT_DELAY"]})])
+
+        async def call(delay: str) -> float:
+            overrides = manager.validate_overrides("fake", {"env": {"FAKE_INIT_DELAY": delay}})
+            await manager.call_tool("fake", "echo", {"text": delay}, gateway.CallContext(overrides=overrides))
+            return time.monotonic()
+
+        started = time.monotonic()
+        slow, fast = await asyncio.gather(call("2"), call("0"))
+        self.assertLess(fast - started, 1.5)
+        self.assertGreaterEqual(slow - started, 2)
+
+    async def test_concurrent_calls_share_one_instance(self):
+        manager = self.load([fake_service("fake", overridable={"env": ["FAKE_INIT_DELAY"]})])
+        overrides = manager.validate_overrides("fake", {"env": {"FAKE_INIT_DELAY": "0.5"}})
+        ctx = gateway.CallContext(overrides=overrides)
+        await asyncio.gather(*(manager.call_tool("fake", "echo", {"text": "x"}, ctx) for _ in range(5)))
+        self.assertEqual(len(manager.instances["fake"]), 1)
+
+    async def test_instance_call_is_validated(self):
+        manager = self.load([fake_service("fake", overridable={"args": ["--tenant"]})])
+        overrides = manager.validate_overrides("fake", {"args": {"--tenant": "a"}})
+        with self.assertRaises(web.HTTPBadRequest):
+            await manager.call_tool("fake", "echo", {}, gateway.CallContext(overrides=overrides))
+
+
+class RepairJsonTest(unittest.TestCase):
+    """lenientJson 修复：每种容忍的不合规写法"""
+
+    def repaired(self, text: str):
+        return json.loads(gateway.repair_json(text), parse_constant=gateway.reject_constant)
+
+    def test_trailing_comma_in_object(self):
+        self.assertEqual(self.repaired('{"a": 1, "b": 2,}'), {"a": 1, "b": 2})
+
+    def test_trailing_comma_in_array(self):
+        self.assertEqual(self.repaired('[1, 2,\n ]'), [1, 2])
+
+    def test_nonfinite_numbers_become_null(self):
+        self.assertEqual(self.repaired('[NaN, Infinity, -Infinity]'), [None, None, None])
+
+    def test_strings_are_left_untouched(self):
+        text = '{"text": "a, ] NaN,}", "quote": "say \\"x,}\\""}'
+        self.assertEqual(self.repaired(text), json.loads(text))
+
+    def test_valid_json_is_unchanged(self):
+        text = '{"a": [1, {"b": "c"}], "d": null}'
+        self.assertEqual(gateway.repair_json(text), text)
+
+
+class LenientJsonTest(GatewayTestCase):
+    """服务输出不合规 JSON：lenientJson 开启时修复，默认严格解析"""
+
+    async def test_malformed_response_is_repaired(self):
+        manager = self.load([fake_service("fake", lenientJson=True)])
+        await manager.start_service("fake")
+        result = await manager.call_tool("fake", "malformed", {})
+        self.assertEqual(result["content"], [{"type": "text", "text": "a, ]"}])
+        self.assertEqual(result["structuredContent"], {"score": None, "max": None})
+        self.assertEqual(manager._pick("fake").json_repairs, 1)
+
+    async def test_strict_by_default(self):
+        manager = self.load([fake_service("fake", timeout="1s")])
+        await manager.start_service("fake")
+        with self.assertRaises(web.HTTPGatewayTimeout):
+            await manager.call_tool("fake", "malformed", {})
+        self.assertEqual(manager._pick("fake").stdout_noise, 1)
+
+
+class ToolsChangedTest(GatewayTestCase):
+    """notifications/tools/list_changed：刷新缓存并推送 tools_changed 事件"""
+
+    async def test_list_changed_refreshes_cache_and_publishes(self):
+        manager = self.load([fake_service("fake")])
+        await manager.start_service("fake")
+        await manager.list_tools("fake")
+        queue = manager.events.subscribe(gateway.CATALOG_EVENTS)
+        self.addCleanup(manager.events.unsubscribe, queue)
+
+        await manager.call_tool("fake", "toggle_tool", {})
+        event = await asyncio.wait_for(queue.get(), 5)
+        self.assertEqual(event["event"], "tools_changed")
+        self.assertEqual((event["added"], event["removed"]), (["extra"], []))
+        self.assertIn("extra", [t["name"] for t in manager.tools["fake"]])
+
+
+class ListToolsTest(GatewayTestCase):
+    """工具列表拉取"""
+
+    def count_requests(self, manager: gateway.MCPManager, method: str) -> list:
+        """记录发往服务的指定方法请求"""
+        sent = []
+        request = manager._request
+
+        async def counting(running, m, params, *args, **kwargs):
+            if m == method:
+                sent.append(params)
+            return await request(running, m, params, *args, **kwargs)
+        manager._request = counting
+        return sent
+
+    async def test_concurrent_refreshes_share_one_request(self):
+        manager = self.load([fake_service("fake")])
+        await manager.start_service("fake")
+        sent = self.count_requests(manager, "tools/list")
+        results = await asyncio.gather(*(manager.list_tools("fake") for _ in range(20)))
+        self.assertEqual(len(sent), 1)
+        self.assertTrue(all(r == results[0] and r for r in results))
+
+    async def test_paginated_list_is_aggregated(self):
+        manager = self.load([fake_service("fake", env=[{"name": "FAKE_PAGE_SIZE", "value": "3"}])])
+        await manager.start_service("fake")
+        sent = self.count_requests(manager, "tools/list")
+        names = [t["name"] for t in await manager.list_tools("fake")]
+        self.assertEqual(names[:3], ["echo", "sleep", "fail"])
+        self.assertEqual(len(names), len(set(names)))
+        self.assertIn("toggle_tool", names)
+        self.assertEqual(sent, [{}] + [{"cursor": str(i)} for i in range(3, len(names), 3)])
+
+
+class EphemeralTest(GatewayTestCase):
+    """临时模式的预热进程"""
+
+    async def test_warm_spares_are_initialized_and_bounded(self):
+        manager = self.load([fake_service("fake", ephemeral=True, poolSize=2,
+                                          env=[{"name": "FAKE_INIT_DELAY", "value": "0.5"}])])
+        await manager.start_service("fake")
+        spares = manager.pools["fake"]
+        self.assertEqual(len(spares), 2)
+
+        await asyncio.gather(*(manager.call_tool("fake", "echo", {"text": "x"}) for _ in range(4)))
+        # 补充仍在进行：备用列表中只有已完成初始化的进程
+        self.assertTrue(all(m.ready.is_set() for m in spares))
+        await manager._refill("fake")
+        self.assertEqual(len(spares), 2)
+        self.assertTrue(all(m.ready.is_set() for m in spares))
+
+    async def test_ephemeral_call_is_validated(self):
+        manager = self.load([fake_service("fake", ephemeral=True)])
+        with self.assertRaises(web.HTTPBadRequest):
+            await manager.call_tool("fake", "echo", {})
+        with self.assertRaises(web.HTTPNotFound):
+            await manager.call_tool("fake", "missing", {})
+
+
+class FanOutTest(GatewayTestCase):
+    """多服务并发调用"""
+
+    async def fan_out(self, body: dict) -> dict:
+        async def read_json():
+            return body
+        request = SimpleNamespace(headers={}, json=read_json)
+        with mock.patch.object(gateway, "manager", self.manager), \
+                mock.patch.object(gateway.web, "json_response", side_effect=lambda data, **kw: data):
+            return (await gateway.fan_out_call(request))["results"]
+
+    async def test_lazy_services_are_started_and_stopped_ones_rejected(self):
+        self.load([fake_service("lazy", startOnBoot=False), fake_service("temp", ephemeral=True),
+                   fake_service("idle")])
+        results = await self.fan_out({"services": ["lazy", "temp", "idle"],
+                                      "tool": "echo", "arguments": {"text": "hi"}})
+        self.assertTrue(results["lazy"]["success"])
+        self.assertTrue(results["temp"]["success"])
+        self.assertEqual(results["idle"]["status"], 409)
+        self.assertEqual(self.manager.get_status("lazy"), "running")
+
+
+class SkillTest(GatewayTestCase):
+    """SKILL.md 导出"""
+
+    async def test_lazy_service_is_started_for_export(self):
+        manager = self.load([fake_service("lazy", startOnBoot=False), fake_service("idle")])
+        with mock.patch.object(gateway, "manager", manager):
+            path = await gateway.write_skill("lazy", self.tmp.name, "http://127.0.0.1:8080")
+            with self.assertRaises(web.HTTPConflict):
+                await gateway.write_skill("idle", self.tmp.name, "http://127.0.0.1:8080")
+        with open(path) as f:
+            self.assertIn("echo", f.read())
+
+
+class ShapeResultTest(unittest.TestCase):
+    """resultMode 结果转换"""
+
+    RESULT = {"content": [{"type": "text", "text": '{"a": 1}'}], "structuredContent": {"a": 1}}
+
+    def test_auto_uses_output_schema(self):
+        self.assertEqual(gateway.shape_result(self.RESULT, "auto", True),
+                         ({"a": 1}, {"resultMode": "structured", "resultBasis": "outputSchema"}))
+
+    def test_auto_without_output_schema_is_unchanged(self):
+        self.assertEqual(gateway.shape_result(self.RESULT, "auto"), (self.RESULT, {"resultBasis": "none"}))
+        text = {"content": [{"type": "text", "text": "x"}]}
+        self.assertEqual(gateway.shape_result(text, "auto", True), (text, {"resultBasis": "outputSchema"}))
+        self.assertEqual(gateway.shape_result(self.RESULT, "raw", True), (self.RESULT, {}))
+
+
+class InitializeAccessTest(GatewayTestCase):
+    """未配置 apiKeys 时 initialize 原始响应仅限本机直连访问"""
+
+    async def get_initialize(self, remote: str):
+        request = SimpleNamespace(match_info={"name": "fake"}, remote=remote, headers={})
+        with mock.patch.object(gateway, "manager", self.manager):
+            return await gateway.get_initialize(request)
+
+    async def test_local_client_is_allowed(self):
+        self.load([fake_service("fake")])
+        with self.assertRaises(web.HTTPConflict):  # 通过访问检查，服务未运行
+            await self.get_initialize("127.0.0.1")
+
+    async def test_loopback_behind_proxy_is_rejected(self):
+        for server in ({"basePath": "/clawmcp"}, {"trustedProxies": ["127.0.0.1"]}):
+            with self.subTest(server=server):
+                self.load([fake_service("fake")], server=server)
+                with self.assertRaises(web.HTTPForbidden):
+                    await self.get_initialize("127.0.0.1")
+
+
+class ContentDispositionTest(unittest.TestCase):
+    """附件文件名来自服务端提供的 URI"""
+
+    def test_plain_name(self):
+        self.assertEqual(gateway.content_disposition("file:///data/report.pdf", "content-0"),
+                         'attachment; filename="report.pdf"')
+
+    def test_unsafe_name_is_sanitized_and_encoded(self):
+        header = gateway.content_disposition('file:///x/a"\r\n; x=1 报告.pdf', "content-0")
+        self.assertEqual(header, "attachment; filename=\"a___x_1___.pdf\"; "
+                                 "filename*=UTF-8''a%22%3B%20x%3D1%20%E6%8A%A5%E5%91%8A.pdf")
+
+    def test_empty_name_uses_fallback(self):
+        for uri in ("", "file:///", "file:///x/.."):
+            with self.subTest(uri=uri):
+                self.assertEqual(gateway.content_disposition(uri, "content-2"), 'attachment; filename="content-2"')
+
+
+class AuthTest(unittest.TestCase):
+    """API Key 校验"""
+
+    def test_api_key_valid(self):
+        keys = ["sekrit", "other"]
+        self.assertTrue(gateway.api_key_valid("other", keys))
+        for given in ("", "sekri", "wrong", "sekrït", "\udcff"):
+            with self.subTest(given=given):
+                self.assertFalse(gateway.api_key_valid(given, keys))
+
+
+class FakePart:
+    """multipart 的一个部分：按给定的分块返回内容"""
+
+    def __init__(self, name: str, chunks: list):
+        self.name = name
+        self.chunks = list(chunks)
+
+    async def read_chunk(self, size: int = 8192) -> bytes:
+        return self.chunks.pop(0) if self.chunks else b""
+
+    def decode(self, data: bytes) -> bytes:
+        return data
+
+
+def multipart_request(*parts: FakePart) -> SimpleNamespace:
+    """没有 Content-Length 的分块 multipart 请求"""
+    async def iterate():
+        for part in parts:
+            yield part
+
+    async def multipart():
+        return iterate()
+    return SimpleNamespace(content_type="multipart/form-data", content_length=None, multipart=multipart)
+
+
+class MultipartTest(unittest.IsolatedAsyncioTestCase):
+    """multipart 调用请求体：逐块读取并按 server.maxBodySize 限制"""
+
+    def setUp(self):
+        patcher = mock.patch.object(gateway.manager.server, "max_body_size", 1024)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    async def test_arguments_are_injected(self):
+        data = await gateway.read_call_body(multipart_request(
+            FakePart("request", [b'{"tool": "echo"}']),
+            FakePart("arguments.text", [b"hello ", "世界".encode()]),
+        ))
+        self.assertEqual(data, {"tool": "echo", "arguments": {"text": "hello 世界"}})
+
+    async def test_chunked_upload_over_limit_is_rejected(self):
+        request = multipart_request(
+            FakePart("request", [b'{"tool": "echo"}']),
+            FakePart("arguments.text", [b"x" * 512] * 4),
+        )
+        with self.assertRaises(web.HTTPRequestEntityTooLarge):
+            await gateway.read_call_body(request)
+
+
+if __name__ == "__main__":
+    unittest.main()